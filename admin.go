@@ -1,6 +1,7 @@
 package httpcache
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -38,7 +39,18 @@ func (a *adminAPI) handleAPIEndpoints(writer http.ResponseWriter, request *http.
 	if a.InternalEndpointHandlers != nil {
 		for k, handler := range *a.InternalEndpointHandlers.Handlers {
 			if strings.Contains(request.RequestURI, k) {
-				handler(writer, request)
+				event, err := a.app.apiPurgeEvent(request, k)
+				if err != nil {
+					return caddy.APIError{
+						HTTPStatus: http.StatusBadRequest,
+						Err:        err,
+					}
+				}
+				w := newCacheResponseWriter(writer)
+				handler(w, request)
+				if event != nil && w.Status() < http.StatusBadRequest {
+					a.app.publishPurge(event)
+				}
 				return nil
 			}
 		}
@@ -74,9 +86,111 @@ func (a *adminAPI) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+func (a *adminAPI) handleStats(writer http.ResponseWriter, request *http.Request) error {
+	if request.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", request.Method),
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(writer).Encode(cacheStats.report(a.app.allStorers()))
+}
+
+func (a *adminAPI) handleStatsReset(writer http.ResponseWriter, request *http.Request) error {
+	if request.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", request.Method),
+		}
+	}
+
+	cacheStats.reset()
+	writer.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// privatePurge identifies the user whose private responses are purged, by
+// identity or by identity hash.
+type privatePurge struct {
+	Identity string `json:"identity,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+func (a *adminAPI) handlePrivatePurge(writer http.ResponseWriter, request *http.Request) error {
+	if request.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", request.Method),
+		}
+	}
+
+	var purge privatePurge
+	if err := json.NewDecoder(request.Body).Decode(&purge); err != nil || (purge.Identity == "") == (purge.Hash == "") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("an identity or a hash is required"),
+		}
+	}
+	if a.app.SurrogateStorage == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("the surrogate keys are disabled"),
+		}
+	}
+
+	hash := purge.Hash
+	if purge.Identity != "" {
+		hash = identityHash(purge.Identity)
+	}
+	a.app.purgePrivate(hash)
+	a.app.publishPurge(&purgeEvent{ID: request.Header.Get(purgeEventIDHeader), Kind: purgeEventPrivate, Hash: hash})
+	writer.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (a *adminAPI) handlePurgeBusStatus(writer http.ResponseWriter, request *http.Request) error {
+	if request.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", request.Method),
+		}
+	}
+	if a.app.bus == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("the purge bus is not configured"),
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(writer).Encode(a.app.bus.status())
+}
+
 // Routes returns the admin routes.
 func (a *adminAPI) Routes() []caddy.AdminRoute {
 	return []caddy.AdminRoute{
+		{
+			Pattern: "/cache/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/cache/stats/reset",
+			Handler: caddy.AdminHandlerFunc(a.handleStatsReset),
+		},
+		{
+			Pattern: "/cache/private/purge",
+			Handler: caddy.AdminHandlerFunc(a.handlePrivatePurge),
+		},
+		{
+			Pattern: "/cache/purge_bus/status",
+			Handler: caddy.AdminHandlerFunc(a.handlePurgeBusStatus),
+		},
 		{
 			Pattern: "/{params...}",
 			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
@@ -1,8 +1,13 @@
 package httpcache
 
 import (
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/darkweak/souin/configurationtypes"
+	"github.com/darkweak/souin/pkg/api"
 	"github.com/darkweak/souin/pkg/storage/types"
 	"github.com/darkweak/souin/pkg/surrogate/providers"
 	"github.com/darkweak/storages/core"
@@ -23,6 +28,17 @@ type SouinApp struct {
 	API configurationtypes.API `json:"api,omitempty"`
 	// Logger level, fallback on caddy's one when not redefined.
 	LogLevel string `json:"log_level,omitempty"`
+
+	// Number of provisioned cache handlers.
+	handlers int
+	logger   core.Logger
+	// Storers of the provisioned cache handlers by name, reported by the
+	// stats admin endpoint.
+	handlerStorers *sync.Map
+	// Bus the purges are broadcast on.
+	bus *purgeBus
+	// Souin API handler the purges of the other nodes are applied with.
+	purgeHandler http.HandlerFunc
 }
 
 func init() {
@@ -30,21 +46,67 @@ func init() {
 }
 
 // Provision implements caddy.Provisioner
-func (s SouinApp) Provision(_ caddy.Context) error {
+func (s *SouinApp) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger().Sugar()
+	s.handlerStorers = &sync.Map{}
+
 	return nil
 }
 
+// addHandlerStorers records the storers of a provisioned cache handler.
+func (s *SouinApp) addHandlerStorers(storers []types.Storer) {
+	for _, storer := range storers {
+		s.handlerStorers.Store(storer.Name(), storer)
+	}
+}
+
+// allStorers returns the storers of every provisioned cache handler.
+func (s *SouinApp) allStorers() []types.Storer {
+	storers := make([]types.Storer, 0)
+	s.handlerStorers.Range(func(_, storer any) bool {
+		storers = append(storers, storer.(types.Storer))
+		return true
+	})
+
+	return storers
+}
+
 // Start will start the App
-func (s SouinApp) Start() error {
+func (s *SouinApp) Start() error {
 	core.ResetRegisteredStorages()
 	_, _ = up.Delete(stored_providers_key)
 	_, _ = up.LoadOrStore(stored_providers_key, newStorageProvider())
 
+	if s.PurgeBus != nil {
+		config := Configuration{
+			API: configurationtypes.API{
+				Souin: configurationtypes.APIEndpoint{Enable: true},
+			},
+			DefaultCache: DefaultCache{
+				TTL: configurationtypes.Duration{
+					Duration: 120 * time.Second,
+				},
+			},
+		}
+		handlers := api.GenerateHandlerMap(&config, s.Storers, s.SurrogateStorage)
+		s.purgeHandler = (*handlers.Handlers)[souinPurgeEndpoint]
+
+		bus, err := newPurgeBus(s.PurgeBus, s.applyPurge, s.logger)
+		if err != nil {
+			return err
+		}
+		s.bus = bus
+	}
+
 	return nil
 }
 
 // Stop will stop the App
-func (s SouinApp) Stop() error {
+func (s *SouinApp) Stop() error {
+	if s.bus != nil {
+		s.bus.close()
+	}
+
 	return nil
 }
 
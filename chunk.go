@@ -0,0 +1,525 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	souinctx "github.com/darkweak/souin/context"
+	"github.com/darkweak/souin/pkg/storage/types"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	// chunksHeader marks the stored responses whose body is a chunk
+	// manifest, it is removed before the response is sent.
+	chunksHeader      = "Cache-Handler-Chunks"
+	chunksStored      = "manifest"
+	chunksUnavailable = "unavailable"
+	chunkKeyPrefix    = "CHUNK_"
+	// The chunks are written before their manifest, they are kept a bit
+	// longer to not expire before it.
+	chunkGrace = time.Minute
+)
+
+var errChunkMissing = errors.New("the chunk is missing from the storers")
+
+// chunkManifest is the body stored in place of a response stored as chunks.
+type chunkManifest struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+func chunkKey(id string, n int64) string {
+	return chunkKeyPrefix + id + "_" + strconv.FormatInt(n, 10)
+}
+
+func newChunkID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// parseChunkManifest returns the manifest of a response marked with the
+// chunks header.
+func parseChunkManifest(marker string, body []byte) (chunkManifest, error) {
+	var m chunkManifest
+	if marker != chunksStored {
+		return m, errChunkMissing
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, err
+	}
+	if m.ID == "" || m.Size < 0 || m.ChunkSize <= 0 {
+		return m, fmt.Errorf("invalid chunk manifest %s", body)
+	}
+
+	return m, nil
+}
+
+// chunkStore writes and reads the chunks in the storers.
+type chunkStore struct {
+	storers []types.Storer
+	size    int64
+}
+
+// write stores the chunk in every storer, it fails if no storer accepted it.
+func (c *chunkStore) write(id string, n int64, b []byte, duration time.Duration) error {
+	var err error
+	stored := false
+	for _, storer := range c.storers {
+		if e := storer.Set(chunkKey(id, n), b, duration); e != nil {
+			err = e
+		} else {
+			stored = true
+		}
+	}
+	if !stored {
+		return err
+	}
+
+	return nil
+}
+
+// read returns the chunk from the first storer having it.
+func (c *chunkStore) read(id string, n int64) ([]byte, error) {
+	for _, storer := range c.storers {
+		if b := storer.Get(chunkKey(id, n)); len(b) > 0 {
+			return b, nil
+		}
+	}
+
+	return nil, errChunkMissing
+}
+
+func (c *chunkStore) delete(id string, count int64) {
+	for n := int64(0); n < count; n++ {
+		for _, storer := range c.storers {
+			storer.Delete(chunkKey(id, n))
+		}
+	}
+}
+
+// chunkReader reads the body of a manifest chunk by chunk.
+type chunkReader struct {
+	store    *chunkStore
+	manifest chunkManifest
+	offset   int64
+	index    int64
+	chunk    []byte
+	err      error
+}
+
+func (c *chunkStore) reader(m chunkManifest) *chunkReader {
+	return &chunkReader{store: c, manifest: m, index: -1}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.Size {
+		return 0, io.EOF
+	}
+	index := r.offset / r.manifest.ChunkSize
+	if index != r.index {
+		chunk, err := r.store.read(r.manifest.ID, index)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.index, r.chunk = index, chunk
+	}
+	start := r.offset - index*r.manifest.ChunkSize
+	if start >= int64(len(r.chunk)) {
+		r.err = errChunkMissing
+		return 0, r.err
+	}
+	n := copy(p, r.chunk[start:])
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+
+	return offset, nil
+}
+
+// chunkable returns whether the upstream response can be stored as chunks
+// and for how long the chunks are kept.
+func (s *SouinCaddyMiddleware) chunkable(r *http.Request, header http.Header, code int) (time.Duration, bool) {
+	if s.chunks == nil || code != http.StatusOK || r.Method != http.MethodGet {
+		return 0, false
+	}
+	if requestCc, err := cacheobject.ParseRequestCacheControl(r.Header.Get("Cache-Control")); err == nil && requestCc.NoStore {
+		return 0, false
+	}
+
+	dc := s.Configuration.DefaultCache
+	_, value := s.SurrogateKeyStorer.GetSurrogateControl(header)
+	if value == "" {
+		value = dc.DefaultCacheControl
+	}
+	responseCc, err := cacheobject.ParseResponseCacheControl(value)
+	if err != nil || responseCc.NoStore || responseCc.PrivatePresent {
+		return 0, false
+	}
+	ttl := dc.TTL.Duration
+	if responseCc.SMaxAge >= 0 {
+		ttl = time.Duration(responseCc.SMaxAge) * time.Second
+	} else if responseCc.MaxAge >= 0 {
+		ttl = time.Duration(responseCc.MaxAge) * time.Second
+	}
+
+	return ttl + dc.Stale.Duration + chunkGrace, true
+}
+
+// chunkedWriter sits between the next handler and the Souin base handler.
+// The responses larger than a chunk are written in the storers chunk by
+// chunk while they are streamed to the client, the Souin base handler only
+// receives their manifest.
+type chunkedWriter struct {
+	rw     http.ResponseWriter
+	r      *http.Request
+	s      *SouinCaddyMiddleware
+	stream *chunkStream
+	client http.ResponseWriter
+	status int
+	ttl    time.Duration
+	// Whether the response is stored as chunks once larger than a chunk.
+	chunking bool
+	large    bool
+	failed   bool
+	id       string
+	buf      []byte
+	size     int64
+	count    int64
+	// Headers of the response given to the Souin base handler, restored
+	// once the headers are sent to the client.
+	saved http.Header
+}
+
+func (s *SouinCaddyMiddleware) newChunkedWriter(rw http.ResponseWriter, r *http.Request, stream *chunkStream) *chunkedWriter {
+	w := &chunkedWriter{rw: rw, r: r, s: s, stream: stream}
+	if stream != nil {
+		w.client = stream.client
+	}
+
+	return w
+}
+
+func (w *chunkedWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *chunkedWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+		w.ttl, w.chunking = w.s.chunkable(w.r, w.Header(), code)
+	}
+	w.rw.WriteHeader(code)
+}
+
+func (w *chunkedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.chunking {
+		return w.rw.Write(b)
+	}
+
+	w.size += int64(len(b))
+	if w.large {
+		w.send(b)
+		if !w.failed {
+			w.buf = append(w.buf, b...)
+		}
+	} else {
+		w.buf = append(w.buf, b...)
+		if int64(len(w.buf)) <= w.s.chunks.size {
+			return len(b), nil
+		}
+		w.large = true
+		w.id = newChunkID()
+		w.sendHeaders()
+		w.send(w.buf)
+	}
+
+	if max := w.s.Configuration.DefaultCache.MaxBodyBytes; max > 0 && uint64(w.size) > max {
+		if err := w.fail(); err != nil {
+			return 0, err
+		}
+	}
+	for !w.failed && int64(len(w.buf)) >= w.s.chunks.size {
+		if err := w.storeChunk(w.buf[:w.s.chunks.size]); err != nil {
+			return 0, err
+		}
+		if w.failed {
+			break
+		}
+		w.buf = append(w.buf[:0], w.buf[w.s.chunks.size:]...)
+	}
+
+	return len(b), nil
+}
+
+// Flush flushes the streamed response to the client.
+func (w *chunkedWriter) Flush() {
+	if w.large && w.client != nil {
+		_ = http.NewResponseController(w.client).Flush()
+	}
+}
+
+// sendHeaders sends the upstream response headers to the client.
+func (w *chunkedWriter) sendHeaders() {
+	if w.client == nil {
+		return
+	}
+	header := w.Header()
+	w.saved = header.Clone()
+	header.Set("Cache-Status", fmt.Sprintf("%s; fwd=uri-miss; key=%s; detail=CHUNKED-STREAM", w.r.Context().Value(souinctx.CacheName), w.r.Context().Value(souinctx.Key)))
+	w.client.WriteHeader(w.status)
+}
+
+func (w *chunkedWriter) send(b []byte) {
+	if w.client == nil {
+		return
+	}
+	_, _ = w.client.Write(b)
+	if w.saved != nil {
+		// The headers are sent with the first bytes, the Souin base
+		// handler stores the ones it received.
+		header := w.Header()
+		for name := range header {
+			delete(header, name)
+		}
+		for name, values := range w.saved {
+			header[name] = values
+		}
+		w.saved = nil
+	}
+}
+
+func (w *chunkedWriter) storeChunk(b []byte) error {
+	// The in-memory storers keep the given slice.
+	if err := w.s.chunks.write(w.id, w.count, bytes.Clone(b), w.ttl); err != nil {
+		w.s.logger.Warnf("Impossible to store the chunk %d of %s: %v", w.count, w.r.RequestURI, err)
+		return w.fail()
+	}
+	w.count++
+
+	return nil
+}
+
+// fail drops the stored chunks, the rest of the response is only streamed.
+// Without a client, e.g. for the ranges, the bytes already received are
+// written to the Souin base handler and the rest of the response is passed
+// through.
+func (w *chunkedWriter) fail() error {
+	if w.failed {
+		return nil
+	}
+	w.failed = true
+	defer w.s.chunks.delete(w.id, w.count)
+	buf := w.buf
+	w.buf = nil
+	if w.client != nil {
+		return nil
+	}
+
+	w.chunking, w.large = false, false
+	for n := int64(0); n < w.count; n++ {
+		chunk, err := w.s.chunks.read(w.id, n)
+		if err != nil {
+			w.Header().Set(chunksHeader, chunksUnavailable)
+			return err
+		}
+		if _, err = w.rw.Write(chunk); err != nil {
+			return err
+		}
+	}
+	_, err := w.rw.Write(buf)
+
+	return err
+}
+
+// close hands the buffered response or the manifest of the chunks to the
+// Souin base handler.
+func (w *chunkedWriter) close() {
+	if !w.large {
+		if len(w.buf) > 0 {
+			_, _ = w.rw.Write(w.buf)
+		}
+		return
+	}
+	if w.client != nil {
+		w.stream.setStreamed()
+	}
+	if !w.failed && len(w.buf) > 0 {
+		_ = w.storeChunk(w.buf)
+	}
+	if w.failed {
+		if w.client != nil {
+			w.Header().Set(chunksHeader, chunksUnavailable)
+		}
+		return
+	}
+
+	manifest, _ := json.Marshal(chunkManifest{ID: w.id, Size: w.size, ChunkSize: w.s.chunks.size})
+	w.Header().Set(chunksHeader, chunksStored)
+	w.Header().Set("Content-Length", strconv.FormatInt(w.size, 10))
+	_, _ = w.rw.Write(manifest)
+}
+
+const chunkStreamCtxKey ctxKey = "cache_handler.CHUNK_STREAM"
+
+// chunkStream is the client response writer the responses stored as chunks
+// are streamed to while they are fetched.
+type chunkStream struct {
+	mu       sync.Mutex
+	client   http.ResponseWriter
+	streamed bool
+}
+
+func withChunkStream(ctx context.Context, client http.ResponseWriter) (context.Context, *chunkStream) {
+	stream := &chunkStream{client: client}
+
+	return context.WithValue(ctx, chunkStreamCtxKey, stream), stream
+}
+
+func chunkStreamFromContext(ctx context.Context) *chunkStream {
+	stream, _ := ctx.Value(chunkStreamCtxKey).(*chunkStream)
+
+	return stream
+}
+
+// setStreamed records that the response was streamed to the client while
+// it was stored as chunks.
+func (cs *chunkStream) setStreamed() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.streamed = true
+}
+
+// isStreamed returns whether the response was streamed to the client.
+func (cs *chunkStream) isStreamed() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.streamed
+}
+
+// chunkResponseWriter replaces the manifest written by the Souin base
+// handler with the chunks it lists.
+type chunkResponseWriter struct {
+	http.ResponseWriter
+	stream *chunkStream
+	status int
+	marker string
+	body   bytes.Buffer
+}
+
+func newChunkResponseWriter(rw http.ResponseWriter, stream *chunkStream) *chunkResponseWriter {
+	return &chunkResponseWriter{ResponseWriter: rw, stream: stream}
+}
+
+func (w *chunkResponseWriter) WriteHeader(code int) {
+	if w.status != 0 || code < http.StatusOK {
+		if w.marker == "" {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	w.status = code
+	w.marker = w.Header().Get(chunksHeader)
+	if w.marker == "" {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.Header().Del(chunksHeader)
+}
+
+func (w *chunkResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.marker == "" {
+		return w.ResponseWriter.Write(b)
+	}
+
+	return w.body.Write(b)
+}
+
+// finish writes the chunks listed by the manifest.
+func (w *chunkResponseWriter) finish(s *SouinCaddyMiddleware, r *http.Request) error {
+	if w.marker == "" || w.stream.isStreamed() {
+		return nil
+	}
+
+	m, err := parseChunkManifest(w.marker, w.body.Bytes())
+	if err != nil {
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusBadGateway)
+		return nil
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.status != http.StatusOK || r.Method == http.MethodHead {
+		return nil
+	}
+
+	reader := s.chunks.reader(m)
+	if _, err = io.Copy(w.ResponseWriter, reader); reader.err != nil {
+		s.purgeChunked(r)
+		return reader.err
+	}
+
+	return err
+}
+
+// purgeChunked removes the entry served from the storers when one of its
+// chunks is missing, the next request stores it again.
+func (s *SouinCaddyMiddleware) purgeChunked(r *http.Request) {
+	served := servedEntryFromContext(r.Context())
+	if served == nil {
+		return
+	}
+	storageKey, _, _, ok := served.fresh()
+	if !ok {
+		storageKey, _, ok = served.promotedStale()
+	}
+	if !ok {
+		return
+	}
+	for _, storer := range s.SouinBaseHandler.Storers {
+		purgeVariants(storer, storageKey)
+	}
+}
+
+var (
+	_ http.ResponseWriter = (*chunkedWriter)(nil)
+	_ http.Flusher        = (*chunkedWriter)(nil)
+	_ http.ResponseWriter = (*chunkResponseWriter)(nil)
+)
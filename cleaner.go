@@ -29,6 +29,12 @@ func (s *storage_providers) Add(key interface{}) {
 
 func (s *SouinCaddyMiddleware) Cleanup() error {
 	s.logger.Debug("Cleanup...")
+	if s.revalidator != nil {
+		s.revalidator.stop()
+	}
+	if s.locks != nil {
+		_ = s.locks.backend.close()
+	}
 	td := []interface{}{}
 	sp, _ := up.LoadOrStore(stored_providers_key, newStorageProvider())
 	stored_providers := sp.(*storage_providers)
@@ -0,0 +1,383 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	souinctx "github.com/darkweak/souin/context"
+	"github.com/darkweak/souin/pkg/rfc"
+)
+
+const (
+	coalescingRetry = "retry"
+	coalescingStale = "stale"
+	coalescingError = "error"
+
+	// coalescedField is the targeted field recorded when the Cache-Control
+	// header of the response shared with a waiting request has been
+	// replaced, only the leader request stores the response.
+	coalescedField = "coalesced"
+
+	detailCoalesced         = "COALESCED"
+	detailCoalescingFailure = "COALESCING-LEADER-FAILED"
+)
+
+var (
+	errCoalescingTimeout = errors.New("coalescing timeout")
+	errCoalescingAborted = errors.New("the coalescing leader request has been aborted")
+)
+
+// coalescer makes the concurrent requests of a key wait for the upstream
+// response of the first one, the leader, instead of forwarding them.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	cfg     Coalescing
+}
+
+func newCoalescer(cfg *Coalescing) *coalescer {
+	return &coalescer{
+		flights: map[string]*flight{},
+		cfg:     *cfg,
+	}
+}
+
+// flight is the upstream request of a leader, its response is shared with
+// the waiting requests once done is closed.
+type flight struct {
+	done    chan struct{}
+	waiters int
+
+	status        int
+	header        http.Header
+	body          []byte
+	requestHeader http.Header
+	err           error
+	// Whether the leader request failed, until it lands.
+	failed bool
+	// Whether the response can be shared with the waiting requests.
+	shared bool
+}
+
+// join returns the flight of the key and whether the request leads it, nil
+// when the waiters limit of the key is reached.
+func (c *coalescer) join(key string) (*flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		if c.cfg.MaxWaiters > 0 && f.waiters >= c.cfg.MaxWaiters {
+			return nil, false
+		}
+		f.waiters++
+
+		return f, false
+	}
+
+	f := &flight{done: make(chan struct{}), failed: true}
+	c.flights[key] = f
+
+	return f, true
+}
+
+// land shares the response of the leader with the waiting requests.
+func (c *coalescer) land(key string, f *flight) {
+	c.mu.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// wait waits for the leader response until the timeout or the request
+// cancellation.
+func (c *coalescer) wait(ctx context.Context, f *flight) error {
+	defer func() {
+		c.mu.Lock()
+		f.waiters--
+		c.mu.Unlock()
+	}()
+	var timeout <-chan time.Time
+	if c.cfg.Timeout.Duration > 0 {
+		timer := time.NewTimer(c.cfg.Timeout.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-f.done:
+		return nil
+	case <-timeout:
+		return errCoalescingTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// varies returns whether the request differs from the leader one in the
+// headers the response varies on.
+func (f *flight) varies(rq *http.Request) bool {
+	if f.header.Get("Vary") == "" {
+		return false
+	}
+	varied, star := rfc.VariedHeaderAllCommaSepValues(f.header)
+	if star {
+		return true
+	}
+
+	return slices.ContainsFunc(varied, func(name string) bool {
+		return rq.Header.Get(name) != f.requestHeader.Get(name)
+	})
+}
+
+// flightResponseWriter records the upstream response of the leader request.
+type flightResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	flight *flight
+	body   bytes.Buffer
+}
+
+func (w *flightResponseWriter) WriteHeader(code int) {
+	if w.flight.status == 0 && code >= http.StatusOK {
+		w.flight.status = code
+		w.flight.header = w.Header().Clone()
+	}
+	w.ResponseWriterWrapper.WriteHeader(code)
+}
+
+// GetStatusCode returns the status code of the leader response.
+func (w *flightResponseWriter) GetStatusCode() int {
+	if sw, ok := w.ResponseWriter.(interface{ GetStatusCode() int }); ok {
+		return sw.GetStatusCode()
+	}
+
+	return w.flight.status
+}
+
+func (w *flightResponseWriter) Write(b []byte) (int, error) {
+	_, _ = w.body.Write(b)
+
+	return w.ResponseWriterWrapper.Write(b)
+}
+
+// coalescingState is what the coalescing did for a request.
+type coalescingState struct {
+	mu sync.Mutex
+	// Cache-Status of the response shared with the request by the leader
+	// of its key.
+	status string
+	// Releases the cluster lock of the key taken to fetch it.
+	release func()
+	// Flight led by the request and its storage key, landed once the
+	// response is stored.
+	flight    *flight
+	flightKey string
+}
+
+// setStatus records the Cache-Status of the response shared with the
+// request while it waited for the leader of its key.
+func (st *coalescingState) setStatus(status string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status = status
+}
+
+// sharedStatus returns the Cache-Status given to setStatus.
+func (st *coalescingState) sharedStatus() (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.status, st.status != ""
+}
+
+// setFlight records the flight led by the request.
+func (st *coalescingState) setFlight(storageKey string, f *flight) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.flightKey, st.flight = storageKey, f
+}
+
+// takeFlight returns the flight given to setFlight, once.
+func (st *coalescingState) takeFlight() (string, *flight) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f := st.flight
+	st.flight = nil
+
+	return st.flightKey, f
+}
+
+// setUnlock records the function releasing the cluster lock of the key once
+// the response is stored.
+func (st *coalescingState) setUnlock(release func()) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.release = release
+}
+
+// unlock releases the cluster lock given to setUnlock.
+func (st *coalescingState) unlock() {
+	st.mu.Lock()
+	release := st.release
+	st.release = nil
+	st.mu.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+// coalescable returns whether the request waits for the upstream response of
+// a concurrent request with the same key. The conditional requests are
+// revalidations, the response depends on their validators.
+func (s *SouinCaddyMiddleware) coalescable(rq *http.Request) bool {
+	if s.coalescer == nil || rq.Header.Get("If-None-Match") != "" || rq.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	// The partial responses to the forwarded ranges are not shared.
+	if rq.Header.Get("Range") != "" && !widenedRange(rq.Context()) {
+		return false
+	}
+	key, _ := storageKeyFromContext(rq)
+
+	return key != ""
+}
+
+// coalesce forwards the request as the leader of its key or waits for the
+// response of the leader. fetch forwards the request to the upstream.
+func (s *SouinCaddyMiddleware) coalesce(rw http.ResponseWriter, rq *http.Request, state *coalescingState, retried bool, fetch func(http.ResponseWriter) error) error {
+	_, storageKey := storageKeyFromContext(rq)
+	f, leader := s.coalescer.join(storageKey)
+	if f == nil {
+		s.logger.Debugf("Coalescing waiters limit reached for %s, forward the request", storageKey)
+
+		return fetch(rw)
+	}
+	if leader {
+		return s.lead(rw, rq, state, storageKey, f, fetch)
+	}
+
+	s.observeCoalescingWaiter(rq, 1)
+	err := s.coalescer.wait(rq.Context(), f)
+	s.observeCoalescingWaiter(rq, -1)
+	switch {
+	case errors.Is(err, errCoalescingTimeout):
+		s.observeCoalescingTimeout(rq)
+		s.logger.Debugf("Coalescing timeout reached for %s, forward the request", storageKey)
+
+		return fetch(rw)
+	case err != nil:
+		return err
+	}
+
+	if !f.failed {
+		if !f.shared || f.varies(rq) {
+			return fetch(rw)
+		}
+		s.replay(rw, f.status, f.header, f.body)
+		state.setStatus(fmt.Sprintf("%s; fwd=uri-miss; key=%s; detail=%s", rq.Context().Value(souinctx.CacheName), rfc.GetCacheKeyFromCtx(rq.Context()), detailCoalesced))
+
+		return nil
+	}
+
+	switch s.coalescer.cfg.OnError {
+	case coalescingRetry:
+		if !retried {
+			return s.coalesce(rw, rq, state, true, fetch)
+		}
+	case coalescingStale:
+		if s.replayStored(rw, rq, state, true) {
+			return nil
+		}
+	}
+	if f.err != nil {
+		return f.err
+	}
+	s.replay(rw, f.status, f.header, f.body)
+
+	return nil
+}
+
+// lead forwards the request and records its response to share it with the
+// requests waiting for it once its store outcome is known.
+func (s *SouinCaddyMiddleware) lead(rw http.ResponseWriter, rq *http.Request, state *coalescingState, storageKey string, f *flight, fetch func(http.ResponseWriter) error) error {
+	state.setFlight(storageKey, f)
+
+	f.err = errCoalescingAborted
+	w := &flightResponseWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rw}, flight: f}
+	err := s.fetchLocked(w, rq, state, fetch)
+	f.err = err
+	f.body = w.body.Bytes()
+	f.requestHeader = rq.Header
+	f.failed = err != nil || f.status == 0 || f.status >= http.StatusInternalServerError
+	// The response replayed from the storers is shared as well.
+	replayed := f.header.Get(targetedFieldHeader) == coalescedField
+	f.shared = !f.failed && (s.coalescer.cfg.Uncacheable || replayed)
+
+	return err
+}
+
+// landFlight releases the requests waiting for the flight led by the
+// request, they get its response when the Souin base handler stored it.
+// header is the header of the response written by the Souin base handler.
+// The waiting requests are released even if the next handler panicked.
+func (s *SouinCaddyMiddleware) landFlight(st *coalescingState, state *requestState, header http.Header) {
+	storageKey, f := st.takeFlight()
+	if f == nil {
+		return
+	}
+	if !f.failed && !f.shared {
+		_, stored := state.storedSize()
+		f.shared = stored || parseCacheStatus(header.Get("Cache-Status")).Stored
+	}
+	s.coalescer.land(storageKey, f)
+}
+
+// replay writes the response shared with a waiting request, its Cache-Control
+// header is restored before being sent.
+func (s *SouinCaddyMiddleware) replay(rw http.ResponseWriter, status int, header http.Header, body []byte) {
+	h := rw.Header()
+	for name, values := range header {
+		h[name] = slices.Clone(values)
+	}
+	s.overrideCacheControl(h, coalescedField, "no-store")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
+
+// replayStored writes the fresh response stored for the request, or the
+// stale one when allowed. It returns false when there is none.
+func (s *SouinCaddyMiddleware) replayStored(rw http.ResponseWriter, rq *http.Request, state *coalescingState, allowStale bool) bool {
+	_, storageKey := storageKeyFromContext(rq)
+	res, stale, storer := s.storedResponses(rq, storageKey)
+	if res == nil && allowStale {
+		res = stale
+	}
+	if res == nil {
+		return false
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return false
+	}
+
+	rfc.SetCacheStatusHeader(res, storer)
+	status := res.Header.Get("Cache-Status")
+	if res == stale {
+		rfc.HitStaleCache(&res.Header)
+		status = res.Header.Get("Cache-Status") + "; detail=" + detailCoalescingFailure
+	}
+	state.setStatus(status)
+	s.replay(rw, res.StatusCode, res.Header, body)
+
+	return true
+}
@@ -1,14 +1,17 @@
 package httpcache
 
 import (
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
 	"github.com/darkweak/souin/configurationtypes"
 	"github.com/darkweak/storages/core"
+	"github.com/pquerna/cachecontrol/cacheobject"
 )
 
 // DefaultCache the struct
@@ -19,11 +22,18 @@ type DefaultCache struct {
 	AllowedAdditionalStatusCodes []int `json:"allowed_additional_status_codes"`
 	// Badger provider configuration.
 	Badger configurationtypes.CacheProvider `json:"badger"`
+	// Skip the cache without storing the response for the requests carrying
+	// the secret.
+	BypassToken *CacheToken `json:"bypass_token,omitempty"`
 	// The cache name to use in the Cache-Status response header.
 	CacheName string                 `json:"cache_name"`
 	CDN       configurationtypes.CDN `json:"cdn"`
 	// The default Cache-Control header value if none set by the upstream server.
 	DefaultCacheControl string `json:"default_cache_control"`
+	// The default Cache-Control header value evaluated per request with the
+	// Caddy placeholders, default_cache_control is used when it is empty or
+	// invalid.
+	DefaultCacheControlPlaceholder string `json:"default_cache_control_placeholder,omitempty"`
 	// The maximum body size (in bytes) to be stored into cache.
 	MaxBodyBytes uint64 `json:"max_cacheable_body_bytes"`
 	// Redis provider configuration.
@@ -32,8 +42,34 @@ type DefaultCache struct {
 	Headers []string `json:"headers"`
 	// Configure the global key generation.
 	Key configurationtypes.Key `json:"key"`
+	// Query parameters part of the key.
+	KeyQuery *KeyQuery `json:"key_query,omitempty"`
+	// Cookies part of the key.
+	KeyCookies []string `json:"key_cookies,omitempty"`
+	// Remove the cookies that are not part of the key from the forwarded
+	// requests.
+	StripCookies bool `json:"strip_cookies,omitempty"`
+	// Normalization of the request before the key generation.
+	KeyNormalize *KeyNormalize `json:"key_normalize,omitempty"`
+	// Normalization of the requests matching the cache_keys patterns.
+	CacheKeysNormalize []CacheKeyNormalize `json:"cache_keys_normalize,omitempty"`
+	// Size (in bytes) of the chunks the larger responses are stored as.
+	ChunkSize uint64 `json:"chunk_size,omitempty"`
+	// Cache fields to add to the Caddy access log entry.
+	LogFields []string `json:"log_fields"`
 	// Mode defines if strict or bypass.
 	Mode string `json:"mode"`
+	// Lifetime of the error and redirect responses by status.
+	NegativeTTL *NegativeTTL `json:"negative_ttl,omitempty"`
+	// Protection against the cache poisoning through the unkeyed request
+	// headers.
+	PoisoningProtection *PoisoningProtection `json:"poisoning_protection,omitempty"`
+	// Store the private and authenticated responses under a key scoped to
+	// the user identity.
+	Private *PrivateCache `json:"private,omitempty"`
+	// Broadcast the purges of the admin API to the other nodes of the
+	// cluster.
+	PurgeBus *PurgeBus `json:"purge_bus,omitempty"`
 	// Olric provider configuration.
 	Olric configurationtypes.CacheProvider `json:"olric"`
 	// Redis provider configuration.
@@ -46,20 +82,219 @@ type DefaultCache struct {
 	Nuts configurationtypes.CacheProvider `json:"nuts"`
 	// Otter provider configuration.
 	Otter configurationtypes.CacheProvider `json:"otter"`
+	// Refresh the frequently requested entries before they expire.
+	RefreshAhead *RefreshAhead `json:"refresh_ahead,omitempty"`
+	// Skip the lookup and store the response for the requests carrying the
+	// secret.
+	RefreshToken *CacheToken `json:"refresh_token,omitempty"`
 	// Regex to exclude cache.
 	Regex configurationtypes.Regex `json:"regex"`
+	// Size (in bytes) of the slices the upstream responses are fetched and
+	// stored as.
+	Slice uint64 `json:"slice,omitempty"`
 	// Storage providers chaining and order.
 	Storers []string `json:"storers"`
+	// Targeted cache control fields (RFC 9213) taking precedence over Cache-Control.
+	TargetedCacheControl *TargetedCacheControl `json:"targeted_cache_control,omitempty"`
 	// Time before cache or backend access timeout.
 	Timeout configurationtypes.Timeout `json:"timeout"`
 	// Time to live.
 	TTL configurationtypes.Duration `json:"ttl"`
+	// Time to live evaluated per request with the Caddy placeholders, ttl is
+	// used when it is empty or invalid. Like ttl, it only applies to the
+	// responses without max-age, s-maxage or Expires.
+	TTLPlaceholder string `json:"ttl_placeholder,omitempty"`
 	// SimpleFS provider configuration.
 	SimpleFS configurationtypes.CacheProvider `json:"simplefs"`
 	// Stale time to live.
 	Stale configurationtypes.Duration `json:"stale"`
+	// Stale time to live evaluated per request with the Caddy placeholders,
+	// stale is used when it is empty or invalid and is the maximum.
+	StalePlaceholder string `json:"stale_placeholder,omitempty"`
+	// Serve the stale responses within their stale-while-revalidate window
+	// and refresh them in background.
+	StaleWhileRevalidate *StaleWhileRevalidate `json:"stale_while_revalidate,omitempty"`
+	// Store the responses without content coding and encode them for each
+	// client with the Caddy encoders.
+	Transcode *encode.Encode `json:"transcode,omitempty"`
+	// Normalize the request headers the responses vary on.
+	VaryNormalize *VaryNormalize `json:"vary_normalize,omitempty"`
+	// Configure how the concurrent requests of a key wait for the upstream
+	// response of the first one.
+	Coalescing *Coalescing `json:"coalescing,omitempty"`
 	// Disable the coalescing system.
 	DisableCoalescing bool `json:"disable_coalescing"`
+	// Keep the cached responses on successful unsafe requests (RFC 9111 section 4.4).
+	DisableUnsafeInvalidation bool `json:"disable_unsafe_invalidation,omitempty"`
+}
+
+// RefreshAhead configures the refresh of the hot entries before they expire.
+type RefreshAhead struct {
+	// Percentage of the TTL, the entries are refreshed in the last part of their TTL.
+	Threshold float64 `json:"threshold,omitempty"`
+	// Minimum hits of the entry to be refreshed.
+	MinHits int `json:"min_hits,omitempty"`
+}
+
+// Coalescing configures how the concurrent requests of a key wait for the
+// upstream response of the first one, the leader.
+type Coalescing struct {
+	// Maximum duration a request waits for the leader response, it is then
+	// forwarded to the upstream.
+	Timeout configurationtypes.Duration `json:"timeout,omitempty"`
+	// Behaviour of the waiting requests when the leader fails: a new leader
+	// is elected (retry), the stale response is served (stale) or the
+	// failure is shared (error).
+	OnError string `json:"on_error,omitempty"`
+	// Maximum number of requests waiting per key, the next ones are
+	// forwarded to the upstream.
+	MaxWaiters int `json:"max_waiters,omitempty"`
+	// Share the responses that are not stored with the waiting requests.
+	Uncacheable bool `json:"uncacheable,omitempty"`
+	// Coalesce the requests of the nodes sharing the storage.
+	Distributed *DistributedCoalescing `json:"distributed,omitempty"`
+}
+
+// DistributedCoalescing configures the lock the nodes of a cluster take
+// before fetching a key, the other nodes wait for the entry it stores.
+type DistributedCoalescing struct {
+	// Lease of the lock, renewed while the key is fetched. It expires when
+	// the node holding it stops.
+	Lease configurationtypes.Duration `json:"lease,omitempty"`
+	// Maximum duration a node waits for the stored entry, the request is
+	// then forwarded to the upstream.
+	Wait configurationtypes.Duration `json:"wait,omitempty"`
+	// Interval between the lookups of the stored entry.
+	Poll configurationtypes.Duration `json:"poll,omitempty"`
+	// Address of the Redis server storing the locks, the configured storer
+	// is used otherwise. The storer locks are best-effort, concurrent nodes
+	// may still fetch the same key.
+	Redis string `json:"redis,omitempty"`
+}
+
+// CacheToken configures where the request carries the secret triggering a
+// cache behaviour.
+type CacheToken struct {
+	// Request header carrying the secret.
+	Header string `json:"header,omitempty"`
+	// Cookie carrying the secret.
+	Cookie string `json:"cookie,omitempty"`
+	// Query parameter carrying the secret.
+	Query string `json:"query,omitempty"`
+	// Shared secret the trigger value must match.
+	Secret string `json:"secret,omitempty"`
+}
+
+// PoisoningProtection configures how the request headers changing the
+// upstream response without being part of the key are handled.
+type PoisoningProtection struct {
+	// Protected request headers, a list of well known ones when none is set.
+	Headers []string `json:"headers,omitempty"`
+	// Strip the headers from the forwarded cacheable requests (strip), add
+	// them to the key (key) or log the responses differing for requests
+	// only differing in these headers (detect).
+	Mode string `json:"mode,omitempty"`
+}
+
+// PrivateCache configures where the user identity the private responses are
+// scoped to is read from, the Authorization header when none is set.
+type PrivateCache struct {
+	// Request header carrying the identity.
+	Header string `json:"header,omitempty"`
+	// Cookie carrying the identity.
+	Cookie string `json:"cookie,omitempty"`
+	// Placeholder evaluated to the identity, e.g. {http.auth.user.id}. It
+	// is evaluated when the key is built, the handler setting it must run
+	// before the cache one.
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+// PurgeBus configures the message bus the purges of the admin API are
+// broadcast on, every node applies them to its own storers.
+type PurgeBus struct {
+	// Message bus, redis for the Redis pub/sub, nats for a NATS subject or
+	// memory for the nodes running in the same process.
+	Backend string `json:"backend,omitempty"`
+	// Address of the Redis or NATS server.
+	Address string `json:"address,omitempty"`
+	// Redis channel or NATS subject of the purge events.
+	Channel string `json:"channel,omitempty"`
+	// Name of the node in the events and the peers status, the hostname
+	// when none is set.
+	Node string `json:"node,omitempty"`
+}
+
+// NegativeTTL configures the lifetime of the error and redirect responses.
+type NegativeTTL struct {
+	// Lifetime by status code (e.g. 404) or class (e.g. 5xx), the code
+	// takes precedence over its class.
+	Statuses map[string]configurationtypes.Duration `json:"statuses,omitempty"`
+	// Never store a negative response over a fresh successful one.
+	PreservePositive bool `json:"preserve_positive,omitempty"`
+}
+
+// StaleWhileRevalidate configures the background refresh of the stale responses.
+type StaleWhileRevalidate struct {
+	// Number of concurrent background refreshes.
+	Workers int `json:"workers,omitempty"`
+	// Maximum number of pending refreshes, the stale response is served
+	// without refresh when the queue is full.
+	Queue int `json:"queue,omitempty"`
+}
+
+// KeyQuery configures the query parameters part of the key.
+type KeyQuery struct {
+	// Parameters removed from the key, * matches any sequence of characters.
+	Ignore []string `json:"ignore,omitempty"`
+	// Parameters kept in the key, the other ones are removed.
+	Only []string `json:"only,omitempty"`
+	// Sort the parameters by name.
+	Sort bool `json:"sort,omitempty"`
+}
+
+// KeyNormalize configures the normalization of the request before the key
+// generation.
+type KeyNormalize struct {
+	// Lowercase the host.
+	LowercaseHost bool `json:"lowercase_host,omitempty"`
+	// Sort the query parameters by name.
+	SortQuery bool `json:"sort_query,omitempty"`
+	// Remove the trailing slashes of the path.
+	StripTrailingSlash bool `json:"strip_trailing_slash,omitempty"`
+	// Decode the percent-encoded unreserved characters of the query.
+	DecodeUnreserved bool `json:"decode_unreserved,omitempty"`
+	// Remove the query parameters without value.
+	DropEmptyParams bool `json:"drop_empty_params,omitempty"`
+}
+
+// CacheKeyNormalize is the normalization of the requests matching the
+// cache_keys pattern.
+type CacheKeyNormalize struct {
+	Pattern   string       `json:"pattern"`
+	Normalize KeyNormalize `json:"normalize"`
+}
+
+// VaryNormalize configures the normalization of the request headers the
+// responses vary on, to collapse their values into canonical buckets.
+type VaryNormalize struct {
+	// Supported content codings by preference, Accept-Encoding is set to the
+	// preferred one accepted by the client.
+	AcceptEncoding []string `json:"accept_encoding,omitempty"`
+	// Supported languages, Accept-Language is set to the one matching the
+	// client preference, the first one is the default.
+	AcceptLanguage []string `json:"accept_language,omitempty"`
+	// Set the User-Agent to the device class (mobile, tablet or desktop) in
+	// the cache.
+	DeviceClass bool `json:"device_class,omitempty"`
+}
+
+// TargetedCacheControl configures the targeted cache control fields.
+type TargetedCacheControl struct {
+	// Targeted fields by precedence, CDN-Cache-Control is always honored
+	// after them.
+	Fields []string `json:"fields,omitempty"`
+	// Remove the targeted fields from the responses sent to the clients.
+	Strip bool `json:"strip,omitempty"`
 }
 
 // GetAllowedHTTPVerbs returns the allowed verbs to cache
@@ -177,9 +412,10 @@ func (d *DefaultCache) GetMaxBodyBytes() uint64 {
 	return d.MaxBodyBytes
 }
 
-// IsCoalescingDisable returns if the coalescing is disabled
+// IsCoalescingDisable returns if the coalescing is disabled, the handler
+// coalesces the requests itself when it is configured.
 func (d *DefaultCache) IsCoalescingDisable() bool {
-	return d.DisableCoalescing
+	return d.DisableCoalescing || d.Coalescing != nil
 }
 
 // Configuration holder
@@ -386,6 +622,90 @@ func parseSimpleFSConfiguration(c map[string]interface{}) map[string]interface{}
 	return c
 }
 
+func parseKeyQuery(h *caddyfile.Dispenser) (*KeyQuery, error) {
+	query := &KeyQuery{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		directive := h.Val()
+		switch directive {
+		case "ignore", "only":
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.Errf("key query %s requires at least one parameter", directive)
+			}
+			for _, pattern := range args {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, h.Errf("invalid key query %s pattern: %s", directive, pattern)
+				}
+			}
+			if directive == "ignore" {
+				query.Ignore = append(query.Ignore, args...)
+			} else {
+				query.Only = append(query.Only, args...)
+			}
+		case "sort":
+			query.Sort = true
+		default:
+			return nil, h.Errf("unsupported key query directive: %s", directive)
+		}
+	}
+
+	return query, nil
+}
+
+func parseKeyNormalize(h *caddyfile.Dispenser) (*KeyNormalize, error) {
+	normalize := &KeyNormalize{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		directive := h.Val()
+		switch directive {
+		case "lowercase_host":
+			normalize.LowercaseHost = true
+		case "sort_query":
+			normalize.SortQuery = true
+		case "strip_trailing_slash":
+			normalize.StripTrailingSlash = true
+		case "decode_unreserved":
+			normalize.DecodeUnreserved = true
+		case "drop_empty_params":
+			normalize.DropEmptyParams = true
+		default:
+			return nil, h.Errf("unsupported key normalize directive: %s", directive)
+		}
+	}
+
+	return normalize, nil
+}
+
+func parseCacheToken(h *caddyfile.Dispenser, name string) (*CacheToken, error) {
+	token := &CacheToken{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		directive := h.Val()
+		args := h.RemainingArgs()
+		if len(args) != 1 {
+			return nil, h.Errf("%s %s requires a single value", name, directive)
+		}
+		switch directive {
+		case "header":
+			token.Header = args[0]
+		case "cookie":
+			token.Cookie = args[0]
+		case "query":
+			token.Query = args[0]
+		case "secret":
+			token.Secret = args[0]
+		default:
+			return nil, h.Errf("unsupported %s directive: %s", name, directive)
+		}
+	}
+	if token.Secret == "" {
+		return nil, h.Errf("%s requires a secret", name)
+	}
+	if token.Header == "" && token.Cookie == "" && token.Query == "" {
+		return nil, h.Errf("%s requires a header, cookie or query trigger", name)
+	}
+
+	return token, nil
+}
+
 func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal bool) error {
 	for h.Next() {
 		for nesting := h.Nesting(); h.NextBlock(nesting); {
@@ -473,6 +793,12 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 					}
 				}
 				cfg.DefaultCache.Badger = provider
+			case "bypass_token":
+				token, err := parseCacheToken(h, rootOption)
+				if err != nil {
+					return err
+				}
+				cfg.DefaultCache.BypassToken = token
 			case "cache_keys":
 				CacheKeys := cfg.CacheKeys
 				if CacheKeys == nil {
@@ -505,6 +831,12 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 							ck.Hide = true
 						case "headers":
 							ck.Headers = h.RemainingArgs()
+						case "normalize":
+							normalize, err := parseKeyNormalize(h)
+							if err != nil {
+								return err
+							}
+							cfg.DefaultCache.CacheKeysNormalize = append(cfg.DefaultCache.CacheKeysNormalize, CacheKeyNormalize{Pattern: rg, Normalize: *normalize})
 						default:
 							return h.Errf("unsupported cache_keys (%s) directive: %s", rg, directive)
 						}
@@ -550,9 +882,90 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 					}
 				}
 				cfg.DefaultCache.CDN = cdn
+			case "coalescing":
+				coalescing := &Coalescing{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					switch directive {
+					case "timeout":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return h.ArgErr()
+						}
+						timeout, err := time.ParseDuration(args[0])
+						if err != nil || timeout < 0 {
+							return h.Errf("invalid coalescing timeout: %s", args[0])
+						}
+						coalescing.Timeout = configurationtypes.Duration{Duration: timeout}
+					case "on_error":
+						args := h.RemainingArgs()
+						if len(args) != 1 || (args[0] != coalescingRetry && args[0] != coalescingStale && args[0] != coalescingError) {
+							return h.Errf("invalid coalescing on_error: %s", args)
+						}
+						coalescing.OnError = args[0]
+					case "max_waiters":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return h.ArgErr()
+						}
+						maxWaiters, err := strconv.Atoi(args[0])
+						if err != nil || maxWaiters < 0 {
+							return h.Errf("invalid coalescing max_waiters: %s", args[0])
+						}
+						coalescing.MaxWaiters = maxWaiters
+					case "uncacheable":
+						coalescing.Uncacheable = true
+					case "distributed":
+						distributed := &DistributedCoalescing{}
+						for nesting := h.Nesting(); h.NextBlock(nesting); {
+							directive := h.Val()
+							args := h.RemainingArgs()
+							if len(args) != 1 {
+								return h.Errf("coalescing distributed %s requires a single value", directive)
+							}
+							switch directive {
+							case "lease", "wait", "poll":
+								d, err := time.ParseDuration(args[0])
+								if err != nil || d <= 0 {
+									return h.Errf("invalid coalescing distributed %s: %s", directive, args[0])
+								}
+								duration := configurationtypes.Duration{Duration: d}
+								switch directive {
+								case "lease":
+									distributed.Lease = duration
+								case "wait":
+									distributed.Wait = duration
+								default:
+									distributed.Poll = duration
+								}
+							case "redis":
+								distributed.Redis = args[0]
+							default:
+								return h.Errf("unsupported coalescing distributed directive: %s", directive)
+							}
+						}
+						coalescing.Distributed = distributed
+					default:
+						return h.Errf("unsupported coalescing directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.Coalescing = coalescing
 			case "default_cache_control":
 				args := h.RemainingArgs()
-				cfg.DefaultCache.DefaultCacheControl = strings.Join(args, " ")
+				if len(args) > 0 && hasPlaceholder(args[0]) {
+					if len(args) > 2 {
+						return h.Errf("the default_cache_control placeholder and its fallback must be quoted: %s", args)
+					}
+					cfg.DefaultCache.DefaultCacheControlPlaceholder = args[0]
+					if len(args) == 2 {
+						if _, err := cacheobject.ParseResponseCacheControl(args[1]); err != nil {
+							return h.Errf("invalid default_cache_control fallback: %s", args[1])
+						}
+						cfg.DefaultCache.DefaultCacheControl = args[1]
+					}
+				} else {
+					cfg.DefaultCache.DefaultCacheControl = strings.Join(args, " ")
+				}
 			case "max_cacheable_body_bytes":
 				args := h.RemainingArgs()
 				maxBodyBytes, err := strconv.ParseUint(args[0], 10, 64)
@@ -561,6 +974,26 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 				} else {
 					cfg.DefaultCache.MaxBodyBytes = maxBodyBytes
 				}
+			case "chunk_size":
+				args := h.RemainingArgs()
+				if len(args) != 1 {
+					return h.ArgErr()
+				}
+				chunkSize, err := strconv.ParseUint(args[0], 10, 64)
+				if err != nil || chunkSize == 0 {
+					return h.Errf("unsupported chunk_size: %s", args)
+				}
+				cfg.DefaultCache.ChunkSize = chunkSize
+			case "slice":
+				args := h.RemainingArgs()
+				if len(args) != 1 {
+					return h.ArgErr()
+				}
+				slice, err := strconv.ParseUint(args[0], 10, 64)
+				if err != nil || slice == 0 {
+					return h.Errf("unsupported slice: %s", args)
+				}
+				cfg.DefaultCache.Slice = slice
 			case "etcd":
 				cfg.DefaultCache.Distributed = true
 				provider := configurationtypes.CacheProvider{Found: true}
@@ -601,6 +1034,25 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 						config_key.Hide = true
 					case "headers":
 						config_key.Headers = h.RemainingArgs()
+					case "query":
+						query, err := parseKeyQuery(h)
+						if err != nil {
+							return err
+						}
+						cfg.DefaultCache.KeyQuery = query
+					case "normalize":
+						normalize, err := parseKeyNormalize(h)
+						if err != nil {
+							return err
+						}
+						cfg.DefaultCache.KeyNormalize = normalize
+					case "cookies":
+						cfg.DefaultCache.KeyCookies = h.RemainingArgs()
+						if len(cfg.DefaultCache.KeyCookies) == 0 {
+							return h.Errf("key cookies requires at least one cookie name")
+						}
+					case "strip_cookies":
+						cfg.DefaultCache.StripCookies = true
 					default:
 						return h.Errf("unsupported key directive: %s", directive)
 					}
@@ -609,6 +1061,17 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 			case "log_level":
 				args := h.RemainingArgs()
 				cfg.LogLevel = args[0]
+			case "log_fields":
+				args := h.RemainingArgs()
+				if len(args) == 0 {
+					args = availableLogFields
+				}
+				for _, field := range args {
+					if !isAvailableLogField(field) {
+						return h.Errf("unsupported log_fields field: %s", field)
+					}
+				}
+				cfg.DefaultCache.LogFields = args
 			case "mode":
 				args := h.RemainingArgs()
 				if len(args) > 1 {
@@ -699,6 +1162,145 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 					}
 				}
 				cfg.DefaultCache.Redis = provider
+			case "negative_ttl":
+				negativeTTL := &NegativeTTL{Statuses: map[string]configurationtypes.Duration{}}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := strings.ToLower(h.Val())
+					args := h.RemainingArgs()
+					switch {
+					case directive == "preserve_positive":
+						if len(args) != 0 {
+							return h.ArgErr()
+						}
+						negativeTTL.PreservePositive = true
+					case isNegativeStatus(directive):
+						if len(args) != 1 {
+							return h.ArgErr()
+						}
+						ttl, err := time.ParseDuration(args[0])
+						if err != nil || ttl < 0 {
+							return h.Errf("invalid negative_ttl %s lifetime: %s", directive, args[0])
+						}
+						negativeTTL.Statuses[directive] = configurationtypes.Duration{Duration: ttl}
+					default:
+						return h.Errf("unsupported negative_ttl directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.NegativeTTL = negativeTTL
+			case "poisoning_protection":
+				protection := &PoisoningProtection{Mode: poisoningStrip}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					switch directive {
+					case "headers":
+						args := h.RemainingArgs()
+						if len(args) == 0 {
+							return h.Errf("poisoning_protection headers requires at least one header")
+						}
+						protection.Headers = append(protection.Headers, args...)
+					case "mode":
+						args := h.RemainingArgs()
+						if len(args) != 1 || (args[0] != poisoningStrip && args[0] != poisoningKey && args[0] != poisoningDetect) {
+							return h.Errf("invalid poisoning_protection mode: %s", args)
+						}
+						protection.Mode = args[0]
+					default:
+						return h.Errf("unsupported poisoning_protection directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.PoisoningProtection = protection
+			case "private":
+				private := &PrivateCache{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					args := h.RemainingArgs()
+					if len(args) != 1 {
+						return h.Errf("private %s requires a single value", directive)
+					}
+					switch directive {
+					case "header":
+						private.Header = args[0]
+					case "cookie":
+						private.Cookie = args[0]
+					case "placeholder":
+						if !hasPlaceholder(args[0]) {
+							return h.Errf("invalid private placeholder: %s", args[0])
+						}
+						private.Placeholder = args[0]
+					default:
+						return h.Errf("unsupported private directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.Private = private
+			case "purge_bus":
+				if !isGlobal {
+					return h.Err("'purge_bus' block must be global")
+				}
+				bus := &PurgeBus{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					args := h.RemainingArgs()
+					switch directive {
+					case purgeBusRedis, purgeBusNATS:
+						if len(args) != 1 {
+							return h.Errf("purge_bus %s requires the server address", directive)
+						}
+						bus.Backend = directive
+						bus.Address = args[0]
+					case purgeBusMemory:
+						if len(args) != 0 {
+							return h.ArgErr()
+						}
+						bus.Backend = directive
+					case "channel", "node":
+						if len(args) != 1 {
+							return h.Errf("purge_bus %s requires a single value", directive)
+						}
+						if directive == "channel" {
+							bus.Channel = args[0]
+						} else {
+							bus.Node = args[0]
+						}
+					default:
+						return h.Errf("unsupported purge_bus directive: %s", directive)
+					}
+				}
+				if bus.Backend == "" {
+					return h.Err("purge_bus requires a redis, nats or memory backend")
+				}
+				cfg.DefaultCache.PurgeBus = bus
+			case "refresh_ahead":
+				refreshAhead := &RefreshAhead{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					args := h.RemainingArgs()
+					if len(args) != 1 {
+						return h.ArgErr()
+					}
+					switch directive {
+					case "threshold":
+						threshold, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+						if err != nil || threshold <= 0 || threshold >= 100 {
+							return h.Errf("invalid refresh_ahead threshold: %s", args[0])
+						}
+						refreshAhead.Threshold = threshold
+					case "min_hits":
+						minHits, err := strconv.Atoi(args[0])
+						if err != nil || minHits < 0 {
+							return h.Errf("invalid refresh_ahead min_hits: %s", args[0])
+						}
+						refreshAhead.MinHits = minHits
+					default:
+						return h.Errf("unsupported refresh_ahead directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.RefreshAhead = refreshAhead
+			case "refresh_token":
+				token, err := parseCacheToken(h, rootOption)
+				if err != nil {
+					return err
+				}
+				cfg.DefaultCache.RefreshToken = token
 			case "regex":
 				for nesting := h.Nesting(); h.NextBlock(nesting); {
 					directive := h.Val()
@@ -727,13 +1329,65 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 				cfg.DefaultCache.SimpleFS = provider
 			case "stale":
 				args := h.RemainingArgs()
-				stale, err := time.ParseDuration(args[0])
-				if err == nil {
+				if hasPlaceholder(args[0]) {
+					if len(args) != 2 {
+						return h.Errf("the stale placeholder requires a fallback duration: %s", args)
+					}
+					stale, err := time.ParseDuration(args[1])
+					if err != nil || stale < 0 {
+						return h.Errf("invalid stale fallback: %s", args[1])
+					}
+					cfg.DefaultCache.StalePlaceholder = args[0]
+					cfg.DefaultCache.Stale.Duration = stale
+				} else if stale, err := time.ParseDuration(args[0]); err == nil {
 					cfg.DefaultCache.Stale.Duration = stale
 				}
+			case "stale_while_revalidate":
+				swr := &StaleWhileRevalidate{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					args := h.RemainingArgs()
+					if len(args) != 1 {
+						return h.ArgErr()
+					}
+					switch directive {
+					case "workers":
+						workers, err := strconv.Atoi(args[0])
+						if err != nil || workers <= 0 {
+							return h.Errf("invalid stale_while_revalidate workers: %s", args[0])
+						}
+						swr.Workers = workers
+					case "queue":
+						queue, err := strconv.Atoi(args[0])
+						if err != nil || queue < 0 {
+							return h.Errf("invalid stale_while_revalidate queue: %s", args[0])
+						}
+						swr.Queue = queue
+					default:
+						return h.Errf("unsupported stale_while_revalidate directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.StaleWhileRevalidate = swr
 			case "storers":
 				args := h.RemainingArgs()
 				cfg.DefaultCache.Storers = args
+			case "targeted_cache_control":
+				targeted := &TargetedCacheControl{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					switch directive {
+					case "fields":
+						targeted.Fields = h.RemainingArgs()
+						if len(targeted.Fields) == 0 {
+							return h.Errf("targeted_cache_control fields requires at least one field name")
+						}
+					case "strip":
+						targeted.Strip = true
+					default:
+						return h.Errf("unsupported targeted_cache_control directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.TargetedCacheControl = targeted
 			case "timeout":
 				timeout := configurationtypes.Timeout{}
 				for nesting := h.Nesting(); h.NextBlock(nesting); {
@@ -760,12 +1414,51 @@ func parseConfiguration(cfg *Configuration, h *caddyfile.Dispenser, isGlobal boo
 				cfg.DefaultCache.Timeout = timeout
 			case "ttl":
 				args := h.RemainingArgs()
-				ttl, err := time.ParseDuration(args[0])
-				if err == nil {
+				if hasPlaceholder(args[0]) {
+					if len(args) != 2 {
+						return h.Errf("the ttl placeholder requires a fallback duration: %s", args)
+					}
+					ttl, err := time.ParseDuration(args[1])
+					if err != nil || ttl <= 0 {
+						return h.Errf("invalid ttl fallback: %s", args[1])
+					}
+					cfg.DefaultCache.TTLPlaceholder = args[0]
+					cfg.DefaultCache.TTL.Duration = ttl
+				} else if ttl, err := time.ParseDuration(args[0]); err == nil {
 					cfg.DefaultCache.TTL.Duration = ttl
 				}
+			case "transcode":
+				transcode := &encode.Encode{}
+				if err := transcode.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+					return err
+				}
+				cfg.DefaultCache.Transcode = transcode
+			case "vary_normalize":
+				normalize := &VaryNormalize{}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					directive := h.Val()
+					switch directive {
+					case "accept_encoding":
+						normalize.AcceptEncoding = h.RemainingArgs()
+						if len(normalize.AcceptEncoding) == 0 {
+							normalize.AcceptEncoding = defaultVaryEncodings
+						}
+					case "accept_language":
+						normalize.AcceptLanguage = h.RemainingArgs()
+						if len(normalize.AcceptLanguage) == 0 {
+							return h.Errf("vary_normalize accept_language requires at least one language")
+						}
+					case "device_class":
+						normalize.DeviceClass = true
+					default:
+						return h.Errf("unsupported vary_normalize directive: %s", directive)
+					}
+				}
+				cfg.DefaultCache.VaryNormalize = normalize
 			case "disable_coalescing":
 				cfg.DefaultCache.DisableCoalescing = true
+			case "disable_unsafe_invalidation":
+				cfg.DefaultCache.DisableUnsafeInvalidation = true
 			case "disable_surrogate_key":
 				cfg.SurrogateKeyDisabled = true
 			default:
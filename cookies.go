@@ -0,0 +1,72 @@
+package httpcache
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// keyCookiesHeader carries the key cookies values of the request handed to
+// the Souin base handler, it is added to the key headers.
+const keyCookiesHeader = "Cache-Handler-Key-Cookies"
+
+// keyCookies returns the values of the named cookies sent by the client,
+// e.g. session_variant=b; ab_test=1.
+func keyCookies(r *http.Request, names []string) string {
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		if c, err := r.Cookie(name); err == nil {
+			values = append(values, name+"="+c.Value)
+		}
+	}
+
+	return strings.Join(values, "; ")
+}
+
+// isCachedMethod returns whether the requests with the method are cached.
+func (s *SouinCaddyMiddleware) isCachedMethod(method string) bool {
+	verbs := s.Configuration.DefaultCache.AllowedHTTPVerbs
+	if len(verbs) == 0 {
+		verbs = []string{http.MethodGet, http.MethodHead}
+	}
+
+	return slices.Contains(verbs, method)
+}
+
+// forwardedRequest returns the request sent to the upstream, with the
+// normalized vary headers, without the ranges when the complete response is
+// stored, with the range of the requested slice and without the cookies that
+// are not part of the key when strip_cookies is enabled.
+func (s *SouinCaddyMiddleware) forwardedRequest(r *http.Request) *http.Request {
+	rq := withHeaders(s.stripUnkeyedHeaders(r), s.normalizedVaryHeaders(r, true))
+	if widenedRange(r.Context()) {
+		// The complete response is stored to serve the next ranges.
+		rq = rq.Clone(rq.Context())
+		rq.Header.Del("Range")
+		rq.Header.Del("If-Range")
+	}
+	if slice := r.Header.Get(sliceHeader); slice != "" && s.Configuration.DefaultCache.Slice > 0 {
+		rq = rq.Clone(rq.Context())
+		rq.Header.Del(sliceHeader)
+		rq.Header.Set("Range", slice)
+	}
+	dc := s.Configuration.DefaultCache
+	if !dc.StripCookies || r.Header.Get("Cookie") == "" || !s.isCachedMethod(r.Method) {
+		return rq
+	}
+
+	kept := make([]string, 0, len(dc.KeyCookies))
+	for _, c := range r.Cookies() {
+		if slices.Contains(dc.KeyCookies, c.Name) {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+
+	rq = rq.Clone(rq.Context())
+	rq.Header.Del("Cookie")
+	if len(kept) > 0 {
+		rq.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+
+	return rq
+}
@@ -2,7 +2,13 @@ package httpcache
 
 import (
 	"encoding/json"
+	"fmt"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -10,7 +16,9 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
 	"github.com/darkweak/souin/configurationtypes"
+	souinctx "github.com/darkweak/souin/context"
 	"github.com/darkweak/souin/pkg/middleware"
 	surrogates_providers "github.com/darkweak/souin/pkg/surrogate/providers"
 	"github.com/darkweak/storages/core"
@@ -35,6 +43,24 @@ type SouinCaddyMiddleware struct {
 	*middleware.SouinBaseHandler
 	logger        core.Logger
 	cacheKeys     configurationtypes.CacheKeys
+	server        atomic.Value
+	keyContext    *souinctx.Context
+	pendingStores *sync.Map
+	keptMappings  *keptMappings
+	noVarySearch  *noVarySearchRules
+	// Resources whose ranges are forwarded to the upstream.
+	unstorableRanges *unstorableRanges
+	keyNormalizers   []keyNormalizer
+	transcoder       *encode.Encode
+	chunks           *chunkStore
+	revalidator      *revalidator
+	hotEntries       *hotEntries
+	poisoning        *poisoningDetector
+	coalescer        *coalescer
+	locks            *distributedLock
+	route            string
+	// Whether the handler only looks up the cache for the cache matcher.
+	lookupOnly    bool
 	Configuration Configuration
 	// Logger level, fallback on caddy's one when not redefined.
 	LogLevel string `json:"log_level,omitempty"`
@@ -88,9 +114,204 @@ func (SouinCaddyMiddleware) CaddyModule() caddy.ModuleInfo {
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (s *SouinCaddyMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	return s.SouinBaseHandler.ServeHTTP(rw, r, func(w http.ResponseWriter, _ *http.Request) error {
-		return next.ServeHTTP(w, r)
-	})
+	r, token := s.withTokens(r)
+	if token == detailBypassToken {
+		return s.serveBypass(rw, r, next)
+	}
+	if s.Configuration.DefaultCache.Slice > 0 && r.Header.Get(sliceHeader) != "" {
+		// Only the slice requests made by the handler carry the header.
+		r = r.Clone(r.Context())
+		r.Header.Del(sliceHeader)
+	}
+	// The ranges are served from the stored response without content coding.
+	if s.transcoder != nil && !s.isRangeRequest(r) {
+		return s.transcoder.ServeHTTP(rw, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) error {
+			return s.serveHTTP(w, rq, next)
+		}))
+	}
+
+	return s.serveHTTP(rw, r, next)
+}
+
+func (s *SouinCaddyMiddleware) serveHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	crw := newCacheResponseWriter(rw)
+	r, state := withRequestState(r)
+	var err error
+	if s.isSliceRequest(r) {
+		err = s.serveSlices(crw, r, next, state)
+	} else {
+		err = s.serveEntry(crw, r, next, state)
+	}
+
+	result := parseCacheStatus(crw.Header().Get("Cache-Status"))
+	s.logCacheFields(r, result, state)
+	s.observeMetrics(r, result, state)
+	s.recordStats(r, result, crw, state)
+
+	return err
+}
+
+// serveEntry serves the request from the cache or from the next handler,
+// the request is accounted by the caller.
+func (s *SouinCaddyMiddleware) serveEntry(crw *cacheResponseWriter, r *http.Request, next caddyhttp.Handler, state *requestState) error {
+	ctx, served := withServedEntry(r.Context(), s.revalidator != nil && s.Configuration.DefaultCache.StaleWhileRevalidate != nil)
+	ranged := s.isRangeRequest(r)
+	if ranged {
+		ctx = withWidenedRange(ctx, s.widensRange(r))
+	}
+	var stream *chunkStream
+	if s.chunks != nil {
+		// The ranges are written once the response is stored.
+		var client http.ResponseWriter = crw
+		if ranged {
+			client = nil
+		}
+		ctx, stream = withChunkStream(ctx, client)
+	}
+	r = r.WithContext(ctx)
+
+	var out http.ResponseWriter = crw
+	var ranges *rangeResponseWriter
+	var chunks *chunkResponseWriter
+	if ranged {
+		ranges = newRangeResponseWriter(s.chunks)
+		ranges.streamTo(crw, r)
+		out = ranges
+	} else if s.chunks != nil {
+		chunks = newChunkResponseWriter(crw, stream)
+		out = chunks
+	}
+	tracing := isTracing(r.Context())
+	var key string
+	if tracing {
+		_, span := startSpan(r.Context(), spanKey)
+		key, _ = s.cacheKey(r)
+		span.SetAttributes(keyHash(key))
+		span.End()
+	}
+	kr := s.keyRequest(r)
+	coalescing := &coalescingState{}
+	defer s.landFlight(coalescing, state, crw.Header())
+	crw.beforeWriteHeader = func(header http.Header) {
+		s.landFlight(coalescing, state, header)
+		if s.revalidator != nil {
+			s.revalidateInBackground(r, next, header, served)
+			s.refreshAhead(r, next, header, served)
+		}
+		s.restorePrivate(kr, header)
+		s.restoreTargetedCacheControl(header)
+		if status, ok := coalescing.sharedStatus(); ok {
+			header.Set("Cache-Status", status)
+		}
+		header.Del(staleHeader)
+		if isRefresh(r.Context()) {
+			markRefresh(header)
+		}
+	}
+
+	unsafe := !isSafeMethod(r.Method)
+	if unsafe && s.Configuration.DefaultCache.DisableUnsafeInvalidation {
+		defer s.keepMapping(r)()
+	}
+
+	err := s.SouinBaseHandler.ServeHTTP(out, kr, s.upstream(r, next, state, coalescing, tracing))
+	if ranges != nil {
+		if err == nil {
+			err = ranges.serve(s, crw, r)
+		}
+		ranges.close()
+	}
+	if chunks != nil && err == nil {
+		err = chunks.finish(s, r)
+	}
+	s.learnRange(r, state, crw.Header())
+	if _, called := state.upstream(); err == nil && called && unsafe && !s.Configuration.DefaultCache.DisableUnsafeInvalidation {
+		s.invalidateUnsafe(r, crw.Header(), crw.Status())
+	}
+
+	if tracing {
+		s.traceCoalescing(r, key, parseCacheStatus(crw.Header().Get("Cache-Status")), state)
+	}
+	s.releasePendingStore(state)
+	coalescing.unlock()
+
+	return err
+}
+
+// upstream returns the function called by the Souin base handler to fetch
+// the response from the next handler.
+func (s *SouinCaddyMiddleware) upstream(r *http.Request, next caddyhttp.Handler, state *requestState, coalescing *coalescingState, tracing bool) func(http.ResponseWriter, *http.Request) error {
+	return func(rw http.ResponseWriter, rq *http.Request) error {
+		fetch := func(rw http.ResponseWriter) error {
+			return s.fetch(rw, rq, r, next, state, tracing)
+		}
+		if s.coalescable(rq) {
+			return s.coalesce(rw, rq, coalescing, false, fetch)
+		}
+
+		return fetch(rw)
+	}
+}
+
+// fetch forwards the request to the next handler, rq is the request given
+// by the Souin base handler and r the client one.
+func (s *SouinCaddyMiddleware) fetch(rw http.ResponseWriter, rq *http.Request, r *http.Request, next caddyhttp.Handler, state *requestState, tracing bool) error {
+	defer state.trackUpstream()()
+	key, storageKey := storageKeyFromContext(rq)
+	var out http.ResponseWriter = rw
+	var chunked *chunkedWriter
+	if s.chunks != nil {
+		chunked = s.newChunkedWriter(rw, rq, chunkStreamFromContext(r.Context()))
+		out = chunked
+	}
+	out, detected := s.detectPoisoning(out, r, key)
+	defer detected()
+	w := newCacheResponseWriter(out)
+	w.beforeWriteHeader = func(header http.Header) {
+		s.applyTargetedCacheControl(header)
+		s.applyPlaceholders(r, header)
+		s.applyPrivate(rq, header)
+		s.applyNegativeTTL(rq, header, w.Status())
+		s.keepRangeOut(r, header, w.Status())
+		s.noVarySearch.learn(r, header)
+	}
+	store := &pendingStore{ctx: r.Context(), key: key, host: r.Host, route: s.routeName(r), state: state}
+	if key != "" {
+		state.setPendingStore(storageKey, store)
+		s.pendingStores.Store(storageKey, store)
+	}
+	if chunked != nil {
+		defer chunked.close()
+	}
+	forwarded := s.forwardedRequest(r)
+	if !tracing {
+		return next.ServeHTTP(w, forwarded)
+	}
+
+	name := spanUpstream
+	if found, _ := state.lookup(); found {
+		name = spanRevalidate
+	}
+	ctx, span := startSpan(r.Context(), name)
+	if key != "" {
+		span.SetAttributes(keyHash(key))
+	}
+	store.ctx = ctx
+
+	err := next.ServeHTTP(w, forwarded.WithContext(ctx))
+	if sw, ok := rw.(interface{ GetStatusCode() int }); ok {
+		span.SetAttributes(attrStatusCode.Int(sw.GetStatusCode()))
+	}
+	endSpan(span, err)
+
+	return err
+}
+
+// releasePendingStore forgets the response the request was about to store.
+func (s *SouinCaddyMiddleware) releasePendingStore(state *requestState) {
+	if storageKey, store := state.pendingStore(); store != nil {
+		s.pendingStores.CompareAndDelete(storageKey, store)
+	}
 }
 
 func (s *SouinCaddyMiddleware) configurationPropertyMapper() error {
@@ -210,9 +431,76 @@ func (s *SouinCaddyMiddleware) FromApp(app *SouinApp) error {
 	if dc.DefaultCacheControl == "" {
 		s.Configuration.DefaultCache.DefaultCacheControl = appDc.DefaultCacheControl
 	}
+	if dc.DefaultCacheControlPlaceholder == "" {
+		s.Configuration.DefaultCache.DefaultCacheControlPlaceholder = appDc.DefaultCacheControlPlaceholder
+	}
+	if dc.TTLPlaceholder == "" {
+		s.Configuration.DefaultCache.TTLPlaceholder = appDc.TTLPlaceholder
+	}
+	if dc.StalePlaceholder == "" {
+		s.Configuration.DefaultCache.StalePlaceholder = appDc.StalePlaceholder
+	}
+	if dc.RefreshAhead == nil {
+		s.Configuration.DefaultCache.RefreshAhead = appDc.RefreshAhead
+	}
+	if dc.StaleWhileRevalidate == nil {
+		s.Configuration.DefaultCache.StaleWhileRevalidate = appDc.StaleWhileRevalidate
+	}
+	if appDc.DisableUnsafeInvalidation {
+		s.Configuration.DefaultCache.DisableUnsafeInvalidation = true
+	}
+	if dc.KeyQuery == nil {
+		s.Configuration.DefaultCache.KeyQuery = appDc.KeyQuery
+	}
+	if dc.KeyCookies == nil {
+		s.Configuration.DefaultCache.KeyCookies = appDc.KeyCookies
+		s.Configuration.DefaultCache.StripCookies = s.Configuration.DefaultCache.StripCookies || appDc.StripCookies
+	}
+	if dc.Transcode == nil {
+		s.Configuration.DefaultCache.Transcode = appDc.Transcode
+	}
+	if dc.VaryNormalize == nil {
+		s.Configuration.DefaultCache.VaryNormalize = appDc.VaryNormalize
+	}
+	if dc.KeyNormalize == nil {
+		s.Configuration.DefaultCache.KeyNormalize = appDc.KeyNormalize
+	}
+	if dc.CacheKeysNormalize == nil {
+		s.Configuration.DefaultCache.CacheKeysNormalize = appDc.CacheKeysNormalize
+	}
+	if dc.TargetedCacheControl == nil {
+		s.Configuration.DefaultCache.TargetedCacheControl = appDc.TargetedCacheControl
+	}
+	if len(dc.LogFields) == 0 {
+		s.Configuration.DefaultCache.LogFields = appDc.LogFields
+	}
 	if dc.MaxBodyBytes == 0 {
 		s.Configuration.DefaultCache.MaxBodyBytes = appDc.MaxBodyBytes
 	}
+	if dc.ChunkSize == 0 {
+		s.Configuration.DefaultCache.ChunkSize = appDc.ChunkSize
+	}
+	if dc.Slice == 0 {
+		s.Configuration.DefaultCache.Slice = appDc.Slice
+	}
+	if dc.NegativeTTL == nil {
+		s.Configuration.DefaultCache.NegativeTTL = appDc.NegativeTTL
+	}
+	if dc.Coalescing == nil {
+		s.Configuration.DefaultCache.Coalescing = appDc.Coalescing
+	}
+	if dc.PoisoningProtection == nil {
+		s.Configuration.DefaultCache.PoisoningProtection = appDc.PoisoningProtection
+	}
+	if dc.Private == nil {
+		s.Configuration.DefaultCache.Private = appDc.Private
+	}
+	if dc.BypassToken == nil {
+		s.Configuration.DefaultCache.BypassToken = appDc.BypassToken
+	}
+	if dc.RefreshToken == nil {
+		s.Configuration.DefaultCache.RefreshToken = appDc.RefreshToken
+	}
 	if dc.CacheName == "" {
 		s.Configuration.DefaultCache.CacheName = appDc.CacheName
 	}
@@ -260,21 +548,110 @@ func (s *SouinCaddyMiddleware) Provision(ctx caddy.Context) error {
 	ctxApp, _ := ctx.App(moduleName)
 	app := ctxApp.(*SouinApp)
 
+	// The handler cache name identifies the route in the statistics,
+	// fallback on the handler position in the configuration.
+	s.route = s.Configuration.DefaultCache.CacheName
+	if s.route == "" {
+		s.route = strconv.Itoa(app.handlers)
+	}
+	if !s.lookupOnly {
+		app.handlers++
+	}
+
 	if err := s.FromApp(app); err != nil {
 		return err
 	}
 
 	s.parseStorages(ctx)
 
+	if dc := &s.Configuration.DefaultCache; len(dc.KeyCookies) > 0 && !slices.Contains(dc.Key.Headers, keyCookiesHeader) {
+		dc.Key.Headers = append(slices.Clone(dc.Key.Headers), keyCookiesHeader)
+	}
+
+	if s.Configuration.DefaultCache.Slice > 0 {
+		withKeyHeader(&s.Configuration, sliceHeader)
+	}
+	if s.Configuration.DefaultCache.Private != nil {
+		withKeyHeader(&s.Configuration, privateHeader)
+	}
+	if p := s.Configuration.DefaultCache.PoisoningProtection; p != nil {
+		switch p.Mode {
+		case "", poisoningStrip:
+		case poisoningKey:
+			for _, name := range p.unkeyedHeaders() {
+				withKeyHeader(&s.Configuration, name)
+			}
+		case poisoningDetect:
+			s.poisoning = newPoisoningDetector()
+		default:
+			return fmt.Errorf("unsupported poisoning_protection mode: %s", p.Mode)
+		}
+	}
+	if dc := s.Configuration.DefaultCache; dc.Coalescing != nil && !dc.DisableCoalescing {
+		s.coalescer = newCoalescer(dc.Coalescing)
+	}
+	if n := s.Configuration.DefaultCache.NegativeTTL; n != nil {
+		dc := &s.Configuration.DefaultCache
+		dc.AllowedAdditionalStatusCodes = n.allowedStatusCodes(dc.AllowedAdditionalStatusCodes)
+	}
+
 	bh := middleware.NewHTTPCacheHandler(&s.Configuration)
 	surrogates, ok := up.LoadOrStore(surrogate_key, bh.SurrogateKeyStorer)
 	if ok {
 		bh.SurrogateKeyStorer = surrogates.(surrogates_providers.SurrogateInterface)
 	}
 
+	if err := initCacheMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
 	s.SouinBaseHandler = bh
+	s.pendingStores = &sync.Map{}
+	s.keptMappings = newKeptMappings()
+	s.noVarySearch = newNoVarySearchRules()
+	s.unstorableRanges = newUnstorableRanges()
+	app.addHandlerStorers(s.SouinBaseHandler.Storers)
 	if len(app.Storers) == 0 {
-		app.Storers = s.SouinBaseHandler.Storers
+		app.Storers = newInstrumentedStorers(s.SouinBaseHandler.Storers, func(*http.Request) string { return "" }, "admin", nil, nil)
+	}
+	s.SouinBaseHandler.Storers = newInstrumentedStorers(s.SouinBaseHandler.Storers, s.serverName, s.route, s.pendingStores, s.keptMappings)
+	if size := s.Configuration.DefaultCache.ChunkSize; size > 0 {
+		s.chunks = &chunkStore{storers: s.SouinBaseHandler.Storers, size: int64(size)}
+	}
+	if s.coalescer != nil && s.Configuration.DefaultCache.Coalescing.Distributed != nil {
+		locks, err := newDistributedLock(s.Configuration.DefaultCache.Coalescing.Distributed, s.SouinBaseHandler.Storers)
+		if err != nil {
+			return err
+		}
+		s.locks = locks
+		if s.Configuration.DefaultCache.Coalescing.Distributed.Redis == "" {
+			s.logger.Info("The distributed coalescing locks are stored in the storer, they are best-effort without a redis lock backend")
+		}
+	}
+	s.keyContext = newKeyContext(&s.Configuration)
+	normalizers, err := newKeyNormalizers(s.Configuration.DefaultCache.CacheKeysNormalize)
+	if err != nil {
+		return err
+	}
+	s.keyNormalizers = normalizers
+	if t := s.Configuration.DefaultCache.Transcode; t != nil {
+		// The encoders are loaded in a copy, the configuration may be shared
+		// with the other handlers through the global options.
+		transcoder := *t
+		transcoder.EncodingsRaw = maps.Clone(t.EncodingsRaw)
+		if err := transcoder.Provision(ctx); err != nil {
+			return err
+		}
+		if err := transcoder.Validate(); err != nil {
+			return err
+		}
+		s.transcoder = &transcoder
+	}
+	if dc := s.Configuration.DefaultCache; dc.StaleWhileRevalidate != nil || dc.RefreshAhead != nil {
+		s.revalidator = newRevalidator(dc.StaleWhileRevalidate)
+	}
+	if s.Configuration.DefaultCache.RefreshAhead != nil {
+		s.hotEntries = newHotEntries()
 	}
 
 	if app.SurrogateStorage == (surrogates_providers.SurrogateInterface)(nil) {
@@ -1,15 +1,26 @@
 package httpcache
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddytest"
 )
 
@@ -1510,3 +1521,2450 @@ func TestAPIPlatformInvalidation(t *testing.T) {
 		t.Errorf("unexpected list %#v", items)
 	}
 }
+
+// serveUpstream serves the handler on the address until the end of the
+// test, it accepts the connections once it returns.
+func serveUpstream(t *testing.T, addr string, handler http.Handler) {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = http.Serve(listener, handler)
+	}()
+}
+
+type unsafeInvalidationHandler struct {
+	iterator int32
+}
+
+func (t *unsafeInvalidationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	if r.Method == http.MethodPost {
+		w.Header().Set("Location", "/unsafe-invalidation/item")
+		w.Header().Set("Content-Location", "http://example.com/unsafe-invalidation/other")
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.URL.Path, iteration)))
+}
+
+func TestUnsafeMethodInvalidation(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /unsafe-invalidation/* {
+			cache
+			reverse_proxy localhost:9091
+		}
+		route /kept/* {
+			cache {
+				disable_unsafe_invalidation
+			}
+			reverse_proxy localhost:9091
+		}
+	}`, "caddyfile")
+
+	handler := unsafeInvalidationHandler{}
+	serveUpstream(t, ":9091", &handler)
+
+	get := func(path, accept string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+path, nil)
+		req.Header.Set("Accept", accept)
+		return tester.AssertResponseCode(req, http.StatusOK)
+	}
+	isHit := func(resp *http.Response) bool {
+		return strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit;")
+	}
+
+	for _, path := range []string{"/unsafe-invalidation/items", "/unsafe-invalidation/item", "/kept/items"} {
+		for _, accept := range []string{"text/html", "application/json"} {
+			_ = get(path, accept)
+			if resp := get(path, accept); !isHit(resp) {
+				t.Errorf("unexpected %s %s Cache-Status header %v", path, accept, resp.Header.Get("Cache-Status"))
+			}
+		}
+	}
+
+	for _, path := range []string{"/unsafe-invalidation/items", "/kept/items"} {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:9080"+path, nil)
+		_ = tester.AssertResponseCode(req, http.StatusCreated)
+	}
+
+	for _, path := range []string{"/unsafe-invalidation/items", "/unsafe-invalidation/item"} {
+		for _, accept := range []string{"text/html", "application/json"} {
+			if resp := get(path, accept); isHit(resp) {
+				t.Errorf("unexpected invalidated %s %s Cache-Status header %v", path, accept, resp.Header.Get("Cache-Status"))
+			}
+		}
+	}
+	for _, accept := range []string{"text/html", "application/json"} {
+		if resp := get("/kept/items", accept); !isHit(resp) {
+			t.Errorf("unexpected kept %s Cache-Status header %v", accept, resp.Header.Get("Cache-Status"))
+		}
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`
+	{
+		admin localhost:2999
+		http_port     9080
+		https_port    9443
+		cache {
+			log_fields
+		}
+	}
+	localhost:9080 {
+		log {
+			output file %s
+			format json
+		}
+		route /log-fields {
+			cache
+			respond "Hello, log fields!"
+		}
+		route /log-fields-range {
+			cache
+			header Content-Type text/plain
+			respond "Hello, log fields range!"
+		}
+	}`, logFile), "caddyfile")
+
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/log-fields`, 200, "Hello, log fields!")
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/log-fields`, 200, "Hello, log fields!")
+	rangeRq, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/log-fields-range", nil)
+	rangeRq.Header.Set("Range", "bytes=0-4")
+	_, _ = tester.AssertResponse(rangeRq, http.StatusPartialContent, "Hello")
+
+	time.Sleep(100 * time.Millisecond)
+	content, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("unable to read the access log file: %v", err)
+	}
+
+	entries := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		entry := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &entry); err == nil && entry["cache_outcome"] != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("unexpected access log entries %v", string(content))
+	}
+	if entries[0]["cache_outcome"] != "miss" || entries[0]["cache_key"] != "GET-http-localhost:9080-/log-fields" || entries[0]["cache_stored_size"] != float64(18) || entries[0]["cache_backend_latency"] == nil {
+		t.Errorf("unexpected first access log entry %v", entries[0])
+	}
+	if entries[1]["cache_outcome"] != "hit" || entries[1]["cache_storer"] != "DEFAULT" || entries[1]["cache_backend_latency"] != nil {
+		t.Errorf("unexpected second access log entry %v", entries[1])
+	}
+	// The complete response is stored for the range.
+	if entries[2]["cache_outcome"] != "miss" || entries[2]["cache_stored_size"] != float64(24) {
+		t.Errorf("unexpected range access log entry %v", entries[2])
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		https_port    9443
+		cache
+	}
+	localhost:9080 {
+		route /cache-metrics {
+			cache {
+				cache_name Metrics
+			}
+			respond "Hello, metrics!"
+		}
+		route /cache-metrics-range {
+			cache {
+				cache_name MetricsRange
+			}
+			respond "Hello, metrics range!"
+		}
+	}`, "caddyfile")
+
+	metricsRq, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/metrics", nil)
+	metricValue := func(metric string) float64 {
+		resp := tester.AssertResponseCode(metricsRq, http.StatusOK)
+		body, _ := io.ReadAll(resp.Body)
+		for _, line := range strings.Split(string(body), "\n") {
+			if strings.HasPrefix(line, metric+" ") {
+				v, _ := strconv.ParseFloat(strings.TrimPrefix(line, metric+" "), 64)
+				return v
+			}
+		}
+
+		return 0
+	}
+
+	missMetric := `caddy_cache_requests_total{handler="Metrics",host="localhost:9080",outcome="miss",server="srv0",storer=""}`
+	hitMetric := `caddy_cache_requests_total{handler="Metrics",host="localhost:9080",outcome="hit",server="srv0",storer="DEFAULT"}`
+	storedMetric := `caddy_cache_stored_bytes_total{handler="Metrics",host="localhost:9080",server="srv0",storer="DEFAULT"}`
+	rangeStoredMetric := `caddy_cache_stored_bytes_total{handler="MetricsRange",host="localhost:9080",server="srv0",storer="DEFAULT"}`
+	misses, hits, stored, rangeStored := metricValue(missMetric), metricValue(hitMetric), metricValue(storedMetric), metricValue(rangeStoredMetric)
+
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/cache-metrics`, 200, "Hello, metrics!")
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/cache-metrics`, 200, "Hello, metrics!")
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/cache-metrics`, 200, "Hello, metrics!")
+
+	if v := metricValue(missMetric); v != misses+1 {
+		t.Errorf("unexpected miss counter %v, expected %v", v, misses+1)
+	}
+	if v := metricValue(hitMetric); v != hits+2 {
+		t.Errorf("unexpected hit counter %v, expected %v", v, hits+2)
+	}
+	if v := metricValue(storedMetric); v != stored+15 {
+		t.Errorf("unexpected stored bytes counter %v, expected %v", v, stored+15)
+	}
+
+	// The complete response is stored for the range.
+	rangeRq, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/cache-metrics-range", nil)
+	rangeRq.Header.Set("Range", "bytes=0-4")
+	_, _ = tester.AssertResponse(rangeRq, http.StatusPartialContent, "Hello")
+	if v := metricValue(rangeStoredMetric); v != rangeStored+21 {
+		t.Errorf("unexpected stored bytes counter after the range %v, expected %v", v, rangeStored+21)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		https_port    9443
+		cache
+	}
+	localhost:9080 {
+		route /cache-stats {
+			cache {
+				cache_name Stats
+			}
+			respond "Hello, stats!"
+		}
+		route /cache-stats-range {
+			cache {
+				cache_name StatsRange
+			}
+			respond "Hello, stats range!"
+		}
+	}`, "caddyfile")
+
+	resetRq, _ := http.NewRequest(http.MethodPost, "http://localhost:2999/cache/stats/reset", nil)
+	tester.AssertResponseCode(resetRq, http.StatusNoContent)
+
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/cache-stats`, 200, "Hello, stats!")
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/cache-stats`, 200, "Hello, stats!")
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/cache-stats`, 200, "Hello, stats!")
+	rangeRq, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/cache-stats-range", nil)
+	rangeRq.Header.Set("Range", "bytes=0-4")
+	_, _ = tester.AssertResponse(rangeRq, http.StatusPartialContent, "Hello")
+
+	statsRq, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/cache/stats", nil)
+	resp := tester.AssertResponseCode(statsRq, http.StatusOK)
+	var report statsReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("unable to decode the stats: %v", err)
+	}
+
+	route, ok := report.Routes["srv0/Stats"]
+	if !ok {
+		t.Fatalf("missing route stats in %+v", report.Routes)
+	}
+	if route.Hits != 2 || route.Misses != 1 || route.ServedBytes != 26 || route.StoredBytes != 13 || route.Entries != 1 {
+		t.Errorf("unexpected route stats %+v", *route)
+	}
+	// The complete response is stored for the range.
+	if route := report.Routes["srv0/StatsRange"]; route == nil || route.Misses != 1 || route.StoredBytes != 19 {
+		t.Errorf("unexpected range route stats %+v", route)
+	}
+	if host := report.Hosts["localhost:9080"]; host == nil || host.Hits != 2 || host.Misses != 2 {
+		t.Errorf("unexpected host stats %+v", host)
+	}
+	if storer := report.Storers["DEFAULT"]; storer == nil || storer.Hits != 2 || storer.StoredBytes != 32 || storer.Entries < 1 {
+		t.Errorf("unexpected storer stats %+v", storer)
+	}
+
+	tester.AssertResponseCode(resetRq, http.StatusNoContent)
+	resp = tester.AssertResponseCode(statsRq, http.StatusOK)
+	report = statsReport{}
+	_ = json.NewDecoder(resp.Body).Decode(&report)
+	if host := report.Hosts["localhost:9080"]; host == nil || host.Hits != 0 || host.Misses != 0 || host.Entries < 1 {
+		t.Errorf("unexpected host stats after reset %+v", host)
+	}
+	if route := report.Routes["srv0/Stats"]; route == nil || route.Entries != 1 || route.Hits != 0 {
+		t.Errorf("unexpected route stats after reset %+v", route)
+	}
+}
+
+type staleWhileRevalidateHandler struct {
+	iterator int32
+}
+
+func (t *staleWhileRevalidateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=2, stale-while-revalidate=10")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello stale-while-revalidate %d!", iteration)))
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache {
+			stale 10s
+		}
+	}
+	localhost:9080 {
+		route /stale-while-revalidate {
+			cache {
+				stale_while_revalidate {
+					workers 1
+				}
+			}
+			reverse_proxy localhost:9088
+		}
+	}`, "caddyfile")
+
+	handler := staleWhileRevalidateHandler{}
+	serveUpstream(t, ":9088", &handler)
+
+	resp1, _ := tester.AssertGetResponse(`http://localhost:9080/stale-while-revalidate`, http.StatusOK, "Hello stale-while-revalidate 1!")
+	if resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/stale-while-revalidate" {
+		t.Errorf("unexpected resp1 Cache-Status header %v", resp1.Header.Get("Cache-Status"))
+	}
+
+	time.Sleep(3 * time.Second)
+	resp2, _ := tester.AssertGetResponse(`http://localhost:9080/stale-while-revalidate`, http.StatusOK, "Hello stale-while-revalidate 1!")
+	if !strings.HasSuffix(resp2.Header.Get("Cache-Status"), "; detail=DEFAULT; fwd=stale; detail=BACKGROUND-REVALIDATION") {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	resp3, _ := tester.AssertGetResponse(`http://localhost:9080/stale-while-revalidate`, http.StatusOK, "Hello stale-while-revalidate 2!")
+	if !strings.HasPrefix(resp3.Header.Get("Cache-Status"), "Souin; hit; ttl=") || strings.Contains(resp3.Header.Get("Cache-Status"), "fwd=stale") {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp3.Header.Get("Cache-Status"))
+	}
+	if iterations := atomic.LoadInt32(&handler.iterator); iterations != 2 {
+		t.Errorf("unexpected upstream calls %d, expected 2", iterations)
+	}
+}
+
+type refreshAheadHandler struct {
+	iterator int32
+}
+
+func (t *refreshAheadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=4")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello refresh-ahead %d!", iteration)))
+}
+
+func TestRefreshAhead(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /refresh-ahead {
+			cache {
+				refresh_ahead {
+					threshold 50%
+					min_hits 2
+				}
+			}
+			reverse_proxy localhost:9089
+		}
+	}`, "caddyfile")
+
+	handler := refreshAheadHandler{}
+	serveUpstream(t, ":9089", &handler)
+
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/refresh-ahead`, http.StatusOK, "Hello refresh-ahead 1!")
+	resp2, _ := tester.AssertGetResponse(`http://localhost:9080/refresh-ahead`, http.StatusOK, "Hello refresh-ahead 1!")
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ") {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/refresh-ahead`, http.StatusOK, "Hello refresh-ahead 1!")
+
+	time.Sleep(300 * time.Millisecond)
+	resp4, _ := tester.AssertGetResponse(`http://localhost:9080/refresh-ahead`, http.StatusOK, "Hello refresh-ahead 2!")
+	if !strings.HasPrefix(resp4.Header.Get("Cache-Status"), "Souin; hit; ") {
+		t.Errorf("unexpected resp4 Cache-Status header %v", resp4.Header.Get("Cache-Status"))
+	}
+	if iterations := atomic.LoadInt32(&handler.iterator); iterations != 2 {
+		t.Errorf("unexpected upstream calls %d, expected 2", iterations)
+	}
+
+	metricsRq, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/metrics", nil)
+	resp := tester.AssertResponseCode(metricsRq, http.StatusOK)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `caddy_cache_refresh_ahead_total{handler="0",host="localhost:9080",result="performed",server="srv0"}`) {
+		t.Error("missing the performed refresh-ahead metric")
+	}
+}
+
+type targetedCacheControlHandler struct {
+	iterator int32
+}
+
+func (t *targetedCacheControlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	switch r.URL.Path {
+	case "/cdn-cache-control":
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("CDN-Cache-Control", "max-age=60")
+	case "/targeted-cache-control":
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("CDN-Cache-Control", "no-store")
+		w.Header().Set("Caddy-Cache-Control", "max-age=60")
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello targeted %d!", iteration)))
+}
+
+func TestTargetedCacheControl(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /cdn-cache-control {
+			cache
+			reverse_proxy localhost:9090
+		}
+		route /targeted-cache-control {
+			cache {
+				targeted_cache_control {
+					fields Caddy-Cache-Control
+					strip
+				}
+			}
+			reverse_proxy localhost:9090
+		}
+	}`, "caddyfile")
+
+	handler := targetedCacheControlHandler{}
+	serveUpstream(t, ":9090", &handler)
+
+	resp1, _ := tester.AssertGetResponse(`http://localhost:9080/cdn-cache-control`, http.StatusOK, "Hello targeted 1!")
+	if resp1.Header.Get("Cache-Control") != "max-age=1" || resp1.Header.Get("CDN-Cache-Control") != "max-age=60" {
+		t.Errorf("unexpected resp1 cache control headers %v", resp1.Header)
+	}
+
+	time.Sleep(2 * time.Second)
+	resp2, _ := tester.AssertGetResponse(`http://localhost:9080/cdn-cache-control`, http.StatusOK, "Hello targeted 1!")
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=5") {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+	if resp2.Header.Get("Cache-Control") != "max-age=1" || resp2.Header.Get("CDN-Cache-Control") != "max-age=60" {
+		t.Errorf("unexpected resp2 cache control headers %v", resp2.Header)
+	}
+	if resp2.Header.Get("Cache-Handler-Targeted-Field") != "" {
+		t.Errorf("unexpected resp2 internal header %v", resp2.Header)
+	}
+
+	resp3, _ := tester.AssertGetResponse(`http://localhost:9080/targeted-cache-control`, http.StatusOK, "Hello targeted 2!")
+	if resp3.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/targeted-cache-control" {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp3.Header.Get("Cache-Status"))
+	}
+	if resp3.Header.Get("Cache-Control") != "no-store" || resp3.Header.Get("CDN-Cache-Control") != "" || resp3.Header.Get("Caddy-Cache-Control") != "" {
+		t.Errorf("unexpected resp3 cache control headers %v", resp3.Header)
+	}
+
+	resp4, _ := tester.AssertGetResponse(`http://localhost:9080/targeted-cache-control`, http.StatusOK, "Hello targeted 2!")
+	if !strings.HasPrefix(resp4.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp4 Cache-Status header %v", resp4.Header.Get("Cache-Status"))
+	}
+	if resp4.Header.Get("Cache-Control") != "no-store" || resp4.Header.Get("CDN-Cache-Control") != "" || resp4.Header.Get("Caddy-Cache-Control") != "" {
+		t.Errorf("unexpected resp4 cache control headers %v", resp4.Header)
+	}
+}
+
+func TestKeyQuery(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /key-query {
+			cache {
+				key {
+					query {
+						ignore utm_* fbclid
+						sort
+					}
+				}
+			}
+			respond "Hello key query!"
+		}
+		route /key-query-only {
+			cache {
+				key {
+					query {
+						only id page
+					}
+				}
+			}
+			respond "Hello key query only!"
+		}
+	}`, "caddyfile")
+
+	resp1, _ := tester.AssertGetResponse(`http://localhost:9080/key-query?b=2&a=1&utm_source=x`, http.StatusOK, "Hello key query!")
+	if resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/key-query?a=1&b=2" {
+		t.Errorf("unexpected resp1 Cache-Status header %v", resp1.Header.Get("Cache-Status"))
+	}
+	resp2, _ := tester.AssertGetResponse(`http://localhost:9080/key-query?a=1&utm_medium=y&b=2&fbclid=z`, http.StatusOK, "Hello key query!")
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+	resp3, _ := tester.AssertGetResponse(`http://localhost:9080/key-query?a=2&b=2`, http.StatusOK, "Hello key query!")
+	if resp3.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/key-query?a=2&b=2" {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp3.Header.Get("Cache-Status"))
+	}
+
+	resp4, _ := tester.AssertGetResponse(`http://localhost:9080/key-query-only?id=1&ref=home&page=2`, http.StatusOK, "Hello key query only!")
+	if resp4.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/key-query-only?id=1&page=2" {
+		t.Errorf("unexpected resp4 Cache-Status header %v", resp4.Header.Get("Cache-Status"))
+	}
+}
+
+type noVarySearchHandler struct {
+	iterator int32
+}
+
+func (t *noVarySearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("No-Vary-Search", `key-order, params=("fbclid")`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.URL.RawQuery, iteration)))
+}
+
+func TestNoVarySearch(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /no-vary-search {
+			cache
+			reverse_proxy localhost:9092
+		}
+	}`, "caddyfile")
+
+	handler := noVarySearchHandler{}
+	serveUpstream(t, ":9092", &handler)
+
+	// The rule is learned from the first response.
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/no-vary-search?y=1&x=1&fbclid=a`, http.StatusOK, "Hello y=1&x=1&fbclid=a 1!")
+	resp2, _ := tester.AssertGetResponse(`http://localhost:9080/no-vary-search?fbclid=b&x=1&y=1`, http.StatusOK, "Hello fbclid=b&x=1&y=1 2!")
+	if resp2.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/no-vary-search?x=1&y=1" {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+	resp3, _ := tester.AssertGetResponse(`http://localhost:9080/no-vary-search?y=1&fbclid=c&x=1`, http.StatusOK, "Hello fbclid=b&x=1&y=1 2!")
+	if !strings.HasPrefix(resp3.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp3.Header.Get("Cache-Status"))
+	}
+	_, _ = tester.AssertGetResponse(`http://localhost:9080/no-vary-search?x=2&y=1`, http.StatusOK, "Hello x=2&y=1 3!")
+}
+
+func TestParseNoVarySearch(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		rule  queryRule
+		err   bool
+	}{
+		{value: "", rule: queryRule{}},
+		{value: "key-order", rule: queryRule{sort: true}},
+		{value: "key-order=?1", rule: queryRule{sort: true}},
+		{value: "key-order=?0", rule: queryRule{}},
+		{value: `params=("utm_source" "utm_medium")`, rule: queryRule{ignore: []string{"utm_source", "utm_medium"}}},
+		{value: `params=("a*b" "c?")`, rule: queryRule{ignore: []string{`a\*b`, `c\?`}}},
+		{value: "params", rule: queryRule{restrict: true}},
+		{value: "params=?0", rule: queryRule{}},
+		{value: `params, except=("id" "page")`, rule: queryRule{keep: []string{"id", "page"}, restrict: true}},
+		{value: `except=("id"), params`, rule: queryRule{keep: []string{"id"}, restrict: true}},
+		{value: `key-order, params=("fbclid")`, rule: queryRule{ignore: []string{"fbclid"}, sort: true}},
+		{value: ` params=("fbclid") ,  key-order `, rule: queryRule{ignore: []string{"fbclid"}, sort: true}},
+		{value: "key-order;foo=bar", rule: queryRule{sort: true}},
+		{value: "unknown=?1, key-order", rule: queryRule{sort: true}},
+		{value: `except=("id")`, err: true},
+		{value: `params=("id"), except=("page")`, err: true},
+		{value: "params, except", err: true},
+		{value: `key-order=("id")`, err: true},
+		{value: "params=utm_source", err: true},
+		{value: `params=("utm_source"`, err: true},
+		{value: "params=(utm_source)", err: true},
+		{value: "key-order,", err: true},
+		{value: "key-order params", err: true},
+		{value: "Key-Order", err: true},
+	} {
+		rule, err := parseNoVarySearch(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error for %q, got the rule %+v", tc.value, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(rule, tc.rule) {
+			t.Errorf("unexpected rule for %q: %+v, expected %+v", tc.value, rule, tc.rule)
+		}
+	}
+}
+
+func TestKeyNormalize(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /normalize/* {
+			cache {
+				key {
+					normalize {
+						lowercase_host
+						sort_query
+						strip_trailing_slash
+						decode_unreserved
+						drop_empty_params
+					}
+				}
+				cache_keys {
+					override {
+						normalize {
+							strip_trailing_slash
+						}
+					}
+				}
+			}
+			respond "Hello normalize!"
+		}
+	}`, "caddyfile")
+
+	req1, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/normalize/a/?b=%7e1&c=&a=%2f", nil)
+	req1.Host = "LocalHost:9080"
+	resp1, _ := tester.AssertResponse(req1, http.StatusOK, "Hello normalize!")
+	if resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/normalize/a?a=%2F&b=~1" {
+		t.Errorf("unexpected resp1 Cache-Status header %v", resp1.Header.Get("Cache-Status"))
+	}
+	resp2, _ := tester.AssertGetResponse(`http://localhost:9080/normalize/a?a=%2F&b=~1`, http.StatusOK, "Hello normalize!")
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+
+	resp3, _ := tester.AssertGetResponse(`http://localhost:9080/normalize/override/?b=1&a=1`, http.StatusOK, "Hello normalize!")
+	if resp3.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/normalize/override?b=1&a=1" {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp3.Header.Get("Cache-Status"))
+	}
+}
+
+type keyCookiesHandler struct {
+	iterator int32
+}
+
+func (t *keyCookiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.Header.Get("Cookie"), iteration)))
+}
+
+func TestKeyCookies(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /key-cookies {
+			cache {
+				key {
+					cookies variant ab_test
+					strip_cookies
+				}
+			}
+			reverse_proxy localhost:9093
+		}
+	}`, "caddyfile")
+
+	handler := keyCookiesHandler{}
+	serveUpstream(t, ":9093", &handler)
+
+	get := func(cookie, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/key-cookies", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp, _ := tester.AssertResponse(req, http.StatusOK, body)
+		return resp
+	}
+
+	resp1 := get("variant=a; tracking=1", "Hello variant=a 1!")
+	if resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/key-cookies-variant=a" {
+		t.Errorf("unexpected resp1 Cache-Status header %v", resp1.Header.Get("Cache-Status"))
+	}
+	resp2 := get("tracking=2; variant=a", "Hello variant=a 1!")
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp2.Header.Get("Cache-Status"))
+	}
+	resp3 := get("ab_test=1; variant=b", "Hello ab_test=1; variant=b 2!")
+	if resp3.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/key-cookies-variant=b; ab_test=1" {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp3.Header.Get("Cache-Status"))
+	}
+	_ = get("", "Hello  3!")
+	resp5 := get("tracking=3", "Hello  3!")
+	if !strings.HasPrefix(resp5.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp5 Cache-Status header %v", resp5.Header.Get("Cache-Status"))
+	}
+}
+
+type varyNormalizeHandler struct {
+	iterator int32
+}
+
+func (t *varyNormalizeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Vary", "Accept-Encoding, Accept-Language, User-Agent")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %s %d!", r.Header.Get("Accept-Encoding"), r.Header.Get("Accept-Language"), iteration)))
+}
+
+func TestVaryNormalize(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /vary-normalize {
+			cache {
+				vary_normalize {
+					accept_encoding br gzip
+					accept_language en fr
+					device_class
+				}
+			}
+			reverse_proxy localhost:9094
+		}
+	}`, "caddyfile")
+
+	handler := varyNormalizeHandler{}
+	serveUpstream(t, ":9094", &handler)
+
+	get := func(encoding, language, userAgent, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/vary-normalize", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		req.Header.Set("Accept-Language", language)
+		req.Header.Set("User-Agent", userAgent)
+		resp, _ := tester.AssertResponse(req, http.StatusOK, body)
+		return resp
+	}
+	isHit := func(resp *http.Response) bool {
+		return strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit;")
+	}
+
+	const iPhone, android = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile", "Mozilla/5.0 (Linux; Android 14) Mobile"
+	if resp := get("gzip, br", "fr-CH, en;q=0.5", iPhone, "Hello br fr 1!"); isHit(resp) {
+		t.Errorf("unexpected resp1 Cache-Status header %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("br, gzip", "fr", android, "Hello br fr 1!"); !isHit(resp) {
+		t.Errorf("unexpected resp2 Cache-Status header %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("gzip", "fr", android, "Hello gzip fr 2!"); isHit(resp) {
+		t.Errorf("unexpected resp3 Cache-Status header %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("br;q=0.5, gzip", "fr-FR;q=0.9, de;q=0.8", iPhone, "Hello gzip fr 2!"); !isHit(resp) {
+		t.Errorf("unexpected resp4 Cache-Status header %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("br", "de", "Mozilla/5.0 (X11; Linux x86_64)", "Hello br en 3!"); isHit(resp) {
+		t.Errorf("unexpected resp5 Cache-Status header %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("br", "de", iPhone, "Hello br en 4!"); isHit(resp) {
+		t.Errorf("unexpected resp6 Cache-Status header %v", resp.Header.Get("Cache-Status"))
+	}
+}
+
+func TestNormalizeAcceptEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		codings  []string
+		expected string
+	}{
+		{header: "", codings: defaultVaryEncodings, expected: "identity"},
+		{header: "gzip", codings: defaultVaryEncodings, expected: "gzip"},
+		{header: "gzip, br", codings: defaultVaryEncodings, expected: "br"},
+		{header: "gzip;q=1, br;q=0.5", codings: defaultVaryEncodings, expected: "gzip"},
+		{header: " gzip ; q=0.8 , deflate;Q=0.9", codings: defaultVaryEncodings, expected: "deflate"},
+		{header: "GZIP", codings: defaultVaryEncodings, expected: "gzip"},
+		{header: "*", codings: defaultVaryEncodings, expected: "br"},
+		{header: "*;q=0.5, gzip", codings: defaultVaryEncodings, expected: "gzip"},
+		{header: "br;q=0, *", codings: defaultVaryEncodings, expected: "zstd"},
+		{header: "gzip;q=0", codings: defaultVaryEncodings, expected: "identity"},
+		{header: "gzip;q=invalid", codings: defaultVaryEncodings, expected: "gzip"},
+		{header: "identity, compress", codings: defaultVaryEncodings, expected: "identity"},
+		{header: ",;q=1, ;, gzip", codings: defaultVaryEncodings, expected: "gzip"},
+		{header: "br, gzip", codings: []string{"gzip", "br"}, expected: "gzip"},
+		{header: "br", codings: []string{"gzip"}, expected: "identity"},
+	} {
+		if actual := normalizeAcceptEncoding(tc.header, tc.codings); actual != tc.expected {
+			t.Errorf("unexpected coding for %q with %v: %s, expected %s", tc.header, tc.codings, actual, tc.expected)
+		}
+	}
+}
+
+type transcodeHandler struct {
+	iterator int32
+}
+
+func (t *transcodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.Header.Get("Accept-Encoding"), iteration)))
+}
+
+func TestTranscode(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /transcode {
+			cache {
+				transcode {
+					gzip 5
+					zstd
+					minimum_length 10
+				}
+			}
+			reverse_proxy localhost:9095
+		}
+	}`, "caddyfile")
+
+	handler := transcodeHandler{}
+	serveUpstream(t, ":9095", &handler)
+
+	get := func(encoding string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/transcode", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		return tester.AssertResponseCode(req, http.StatusOK)
+	}
+
+	resp1 := get("gzip")
+	if resp1.Header.Get("Content-Encoding") != "gzip" || resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/transcode" {
+		t.Errorf("unexpected resp1 headers %v", resp1.Header)
+	}
+	reader, err := gzip.NewReader(resp1.Body)
+	if err != nil {
+		t.Fatalf("unexpected gzip error %v", err)
+	}
+	if body, _ := io.ReadAll(reader); string(body) != "Hello identity 1!" {
+		t.Errorf("unexpected resp1 body %s", body)
+	}
+
+	resp2 := get("zstd, gzip;q=0.5")
+	if resp2.Header.Get("Content-Encoding") != "zstd" || !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp2 headers %v", resp2.Header)
+	}
+
+	resp3 := get("identity")
+	if resp3.Header.Get("Content-Encoding") != "" || !strings.HasPrefix(resp3.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp3 headers %v", resp3.Header)
+	}
+	if body, _ := io.ReadAll(resp3.Body); string(body) != "Hello identity 1!" {
+		t.Errorf("unexpected resp3 body %s", body)
+	}
+	if iterations := atomic.LoadInt32(&handler.iterator); iterations != 1 {
+		t.Errorf("unexpected upstream calls %d, expected 1", iterations)
+	}
+}
+
+type rangeHandler struct {
+	iterator int32
+}
+
+func (t *rangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Etag", `"v1"`)
+	if r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("0123456789abcdefghij"))
+}
+
+func TestRangeRequests(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /range {
+			cache
+			reverse_proxy localhost:9096
+		}
+		route /range-forwarded* {
+			cache
+			reverse_proxy localhost:9108
+		}
+	}`, "caddyfile")
+
+	handler := rangeHandler{}
+	serveUpstream(t, ":9096", &handler)
+	forwarded := rangeForwardedHandler{}
+	serveUpstream(t, ":9108", &forwarded)
+
+	get := func(ranges, ifRange string, code int) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/range", nil)
+		req.Header.Set("Range", ranges)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		resp := tester.AssertResponseCode(req, code)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp1, body1 := get("bytes=0-3", "", http.StatusPartialContent)
+	if body1 != "0123" || resp1.Header.Get("Content-Range") != "bytes 0-3/20" || resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/range" {
+		t.Errorf("unexpected resp1 %s %v", body1, resp1.Header)
+	}
+
+	resp2, body2 := get("bytes=-5", "", http.StatusPartialContent)
+	if body2 != "fghij" || resp2.Header.Get("Content-Range") != "bytes 15-19/20" || !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp2 %s %v", body2, resp2.Header)
+	}
+
+	resp3, body3 := get("bytes=0-1,10-11", "", http.StatusPartialContent)
+	if !strings.HasPrefix(resp3.Header.Get("Content-Type"), "multipart/byteranges; boundary=") || !strings.Contains(body3, "Content-Range: bytes 0-1/20") || !strings.Contains(body3, "Content-Range: bytes 10-11/20") {
+		t.Errorf("unexpected resp3 %s %v", body3, resp3.Header)
+	}
+
+	resp4, _ := get("bytes=30-40", "", http.StatusRequestedRangeNotSatisfiable)
+	if resp4.Header.Get("Content-Range") != "bytes */20" {
+		t.Errorf("unexpected resp4 headers %v", resp4.Header)
+	}
+
+	_, body5 := get("bytes=0-3", `"v0"`, http.StatusOK)
+	if body5 != "0123456789abcdefghij" {
+		t.Errorf("unexpected resp5 body %s", body5)
+	}
+
+	_, body6 := get("bytes=4-7", `"v1"`, http.StatusPartialContent)
+	if body6 != "4567" {
+		t.Errorf("unexpected resp6 body %s", body6)
+	}
+
+	if iterations := atomic.LoadInt32(&handler.iterator); iterations != 1 {
+		t.Errorf("unexpected upstream calls %d, expected 1", iterations)
+	}
+
+	forward := func(path, ranges string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Range", ranges)
+		resp := tester.AssertResponseCode(req, http.StatusPartialContent)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// The complete response is requested until it is known to not be stored.
+	resp7, body7 := forward("/range-forwarded", "bytes=2-5", nil)
+	if body7 != "2345" || resp7.Header.Get("Content-Range") != "bytes 2-5/20" || resp7.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("unexpected resp7 %s %v", body7, resp7.Header)
+	}
+	resp8, body8 := forward("/range-forwarded", "bytes=6-7", nil)
+	if body8 != "67" || resp8.Header.Get("Content-Range") != "bytes 6-7/20" || resp8.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("unexpected resp8 %s %v", body8, resp8.Header)
+	}
+	_, body9 := forward("/range-forwarded-cacheable", "bytes=0-1", http.Header{"Cache-Control": []string{"no-store"}})
+	if body9 != "01" {
+		t.Errorf("unexpected resp9 body %s", body9)
+	}
+	// The forwarded partial response is not stored for the complete one.
+	resp10, body10 := forward("/range-forwarded-cacheable", "bytes=2-3", nil)
+	if body10 != "23" || resp10.Header.Get("Cache-Control") != "max-age=60" || resp10.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/range-forwarded-cacheable" {
+		t.Errorf("unexpected resp10 %s %v", body10, resp10.Header)
+	}
+	if ranges := forwarded.received(); !slices.Equal(ranges, []string{"", "bytes=6-7", "bytes=0-1", ""}) {
+		t.Errorf("unexpected forwarded ranges %v", ranges)
+	}
+}
+
+type rangeForwardedHandler struct {
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (t *rangeForwardedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	t.ranges = append(t.ranges, r.Header.Get("Range"))
+	t.mu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Path == "/range-forwarded-cacheable" {
+		w.Header().Set("Cache-Control", "max-age=60")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789abcdefghij"))
+}
+
+func (t *rangeForwardedHandler) received() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Clone(t.ranges)
+}
+
+type chunkedHandler struct {
+	iterator int32
+	release  chan struct{}
+}
+
+func (t *chunkedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Content-Type", "text/plain")
+	if r.URL.Path == "/chunked/small" {
+		_, _ = w.Write([]byte("small"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(strings.Repeat("a", 40)))
+	w.(http.Flusher).Flush()
+	select {
+	case <-t.release:
+	case <-time.After(5 * time.Second):
+	}
+	_, _ = w.Write([]byte(strings.Repeat("b", 30)))
+}
+
+func TestChunkedStorage(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /chunked/* {
+			cache {
+				chunk_size 16
+			}
+			reverse_proxy localhost:9097
+		}
+		route /oversized/* {
+			cache {
+				chunk_size 16
+				max_cacheable_body_bytes 50
+			}
+			reverse_proxy localhost:9097
+		}
+	}`, "caddyfile")
+
+	handler := chunkedHandler{release: make(chan struct{})}
+	serveUpstream(t, ":9097", &handler)
+
+	expected := strings.Repeat("a", 40) + strings.Repeat("b", 30)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/chunked/large", nil)
+	resp1, err := tester.Client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp1.StatusCode != http.StatusOK || resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; key=GET-http-localhost:9080-/chunked/large; detail=CHUNKED-STREAM" {
+		t.Errorf("unexpected resp1 %d %v", resp1.StatusCode, resp1.Header)
+	}
+	// The first bytes are streamed before the upstream sent the whole body.
+	first := make([]byte, 40)
+	if _, err := io.ReadFull(resp1.Body, first); err != nil || string(first) != strings.Repeat("a", 40) {
+		t.Errorf("unexpected resp1 first bytes %s %v", first, err)
+	}
+	close(handler.release)
+	rest, _ := io.ReadAll(resp1.Body)
+	_ = resp1.Body.Close()
+	if string(first)+string(rest) != expected {
+		t.Errorf("unexpected resp1 body %s%s", first, rest)
+	}
+
+	resp2 := tester.AssertResponseCode(req, http.StatusOK)
+	if body, _ := io.ReadAll(resp2.Body); string(body) != expected {
+		t.Errorf("unexpected resp2 body %s", body)
+	}
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") || resp2.Header.Get("Content-Length") != "70" || resp2.Header.Get("Cache-Handler-Chunks") != "" {
+		t.Errorf("unexpected resp2 headers %v", resp2.Header)
+	}
+
+	rangeReq, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/chunked/large", nil)
+	rangeReq.Header.Set("Range", "bytes=30-49")
+	resp3 := tester.AssertResponseCode(rangeReq, http.StatusPartialContent)
+	if body, _ := io.ReadAll(resp3.Body); string(body) != expected[30:50] || resp3.Header.Get("Content-Range") != "bytes 30-49/70" {
+		t.Errorf("unexpected resp3 %s %v", body, resp3.Header)
+	}
+
+	smallReq, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/chunked/small", nil)
+	tester.AssertResponse(smallReq, http.StatusOK, "small")
+	resp4, _ := tester.AssertResponse(smallReq, http.StatusOK, "small")
+	if !strings.HasPrefix(resp4.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp4 headers %v", resp4.Header)
+	}
+
+	// The ranges of a response too large to be stored are served from the
+	// upstream response.
+	oversizedReq, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/oversized/large", nil)
+	oversizedReq.Header.Set("Range", "bytes=30-49")
+	resp5 := tester.AssertResponseCode(oversizedReq, http.StatusPartialContent)
+	if body, _ := io.ReadAll(resp5.Body); string(body) != expected[30:50] || resp5.Header.Get("Content-Range") != "bytes 30-49/70" || resp5.Header.Get("Cache-Handler-Chunks") != "" {
+		t.Errorf("unexpected resp5 %s %v", body, resp5.Header)
+	}
+
+	if iterations := atomic.LoadInt32(&handler.iterator); iterations != 3 {
+		t.Errorf("unexpected upstream calls %d, expected 3", iterations)
+	}
+}
+
+type sliceHandler struct {
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (t *sliceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	t.ranges = append(t.ranges, r.Header.Get("Range"))
+	t.mu.Unlock()
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Etag", `"slice"`)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(sliceBody))
+}
+
+func (t *sliceHandler) requested() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Clone(t.ranges)
+}
+
+var sliceBody = strings.Repeat("0123456789", 10)
+
+func TestSlice(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /slice {
+			cache {
+				slice 30
+			}
+			reverse_proxy localhost:9098
+		}
+	}`, "caddyfile")
+
+	handler := sliceHandler{}
+	serveUpstream(t, ":9098", &handler)
+	resetRq, _ := http.NewRequest(http.MethodPost, "http://localhost:2999/cache/stats/reset", nil)
+	tester.AssertResponseCode(resetRq, http.StatusNoContent)
+
+	get := func(ranges string, code int) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/slice", nil)
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		resp := tester.AssertResponseCode(req, code)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp1, body1 := get("bytes=35-64", http.StatusPartialContent)
+	if body1 != sliceBody[35:65] || resp1.Header.Get("Content-Range") != "bytes 35-64/100" || resp1.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/slice-bytes=0-29" {
+		t.Errorf("unexpected resp1 %s %v", body1, resp1.Header)
+	}
+	if requested := handler.requested(); !slices.Equal(requested, []string{"bytes=0-29", "bytes=30-59", "bytes=60-89"}) {
+		t.Errorf("unexpected upstream ranges %v", requested)
+	}
+
+	resp2, body2 := get("bytes=0-9,70-79", http.StatusPartialContent)
+	if !strings.HasPrefix(resp2.Header.Get("Content-Type"), "multipart/byteranges; boundary=") || !strings.Contains(body2, "Content-Range: bytes 70-79/100") || !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp2 %s %v", body2, resp2.Header)
+	}
+	if requested := handler.requested(); len(requested) != 3 {
+		t.Errorf("unexpected upstream ranges %v", requested)
+	}
+
+	resp3, body3 := get("", http.StatusOK)
+	if body3 != sliceBody || resp3.Header.Get("Content-Length") != "100" || resp3.Header.Get("Content-Range") != "" {
+		t.Errorf("unexpected resp3 %s %v", body3, resp3.Header)
+	}
+	if requested := handler.requested(); !slices.Equal(requested, []string{"bytes=0-29", "bytes=30-59", "bytes=60-89", "bytes=90-119"}) {
+		t.Errorf("unexpected upstream ranges %v", requested)
+	}
+
+	_, body4 := get("", http.StatusOK)
+	if body4 != sliceBody {
+		t.Errorf("unexpected resp4 body %s", body4)
+	}
+	get("bytes=200-", http.StatusRequestedRangeNotSatisfiable)
+	if requested := handler.requested(); len(requested) != 4 {
+		t.Errorf("unexpected upstream ranges %v", requested)
+	}
+
+	// Every client request is accounted once, whatever its slices.
+	statsRq, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/cache/stats", nil)
+	var report statsReport
+	if err := json.NewDecoder(tester.AssertResponseCode(statsRq, http.StatusOK).Body).Decode(&report); err != nil {
+		t.Fatalf("unable to decode the stats: %v", err)
+	}
+	if host := report.Hosts["localhost:9080"]; host == nil || host.Misses != 1 || host.Hits != 4 {
+		t.Errorf("unexpected host stats %+v", host)
+	}
+}
+
+type negativeHandler struct {
+	iterator int32
+	status   atomic.Int32
+}
+
+func (t *negativeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	switch r.URL.Path {
+	case "/negative/missing":
+		w.WriteHeader(http.StatusNotFound)
+	case "/negative/unavailable":
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		status := int(t.status.Load())
+		if status == http.StatusOK {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else if r.URL.Path == "/negative/varied" {
+			w.Header().Set("Vary", "X-Lang")
+		}
+		w.WriteHeader(status)
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello negative %d!", iteration)))
+}
+
+func TestNegativeTTL(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /negative/* {
+			cache {
+				negative_ttl {
+					404 30s
+					5xx 5s
+					preserve_positive
+				}
+			}
+			reverse_proxy localhost:9099
+		}
+	}`, "caddyfile")
+
+	handler := negativeHandler{}
+	handler.status.Store(http.StatusOK)
+	serveUpstream(t, ":9099", &handler)
+
+	ttl := func(resp *http.Response) int {
+		_, after, _ := strings.Cut(resp.Header.Get("Cache-Status"), "; ttl=")
+		value, _ := strconv.Atoi(strings.Split(after, ";")[0])
+		return value
+	}
+
+	missing, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/negative/missing", nil)
+	resp1, _ := tester.AssertResponse(missing, http.StatusNotFound, "Hello negative 1!")
+	if resp1.Header.Get("Cache-Control") != "" || !strings.Contains(resp1.Header.Get("Cache-Status"), "; stored") {
+		t.Errorf("unexpected resp1 headers %v", resp1.Header)
+	}
+	resp2, _ := tester.AssertResponse(missing, http.StatusNotFound, "Hello negative 1!")
+	if !strings.HasPrefix(resp2.Header.Get("Cache-Status"), "Souin; hit; ttl=") || ttl(resp2) > 30 || ttl(resp2) < 25 {
+		t.Errorf("unexpected resp2 headers %v", resp2.Header)
+	}
+
+	unavailable, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/negative/unavailable", nil)
+	resp3, _ := tester.AssertResponse(unavailable, http.StatusServiceUnavailable, "Hello negative 2!")
+	if resp3.Header.Get("Cache-Control") != "max-age=3600" {
+		t.Errorf("unexpected resp3 headers %v", resp3.Header)
+	}
+	resp4, _ := tester.AssertResponse(unavailable, http.StatusServiceUnavailable, "Hello negative 2!")
+	if !strings.HasPrefix(resp4.Header.Get("Cache-Status"), "Souin; hit; ttl=") || ttl(resp4) > 5 {
+		t.Errorf("unexpected resp4 headers %v", resp4.Header)
+	}
+
+	positive, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/negative/positive", nil)
+	tester.AssertResponse(positive, http.StatusOK, "Hello negative 3!")
+	handler.status.Store(http.StatusInternalServerError)
+	revalidate, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/negative/positive", nil)
+	revalidate.Header.Set("Cache-Control", "no-cache")
+	resp5, _ := tester.AssertResponse(revalidate, http.StatusInternalServerError, "Hello negative 4!")
+	if !strings.Contains(resp5.Header.Get("Cache-Status"), "detail=NO-STORE-DIRECTIVE") {
+		t.Errorf("unexpected resp5 headers %v", resp5.Header)
+	}
+	resp6, _ := tester.AssertResponse(positive, http.StatusOK, "Hello negative 3!")
+	if !strings.HasPrefix(resp6.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp6 headers %v", resp6.Header)
+	}
+
+	// The negative response varies, it is stored in another variant than
+	// the positive one.
+	handler.status.Store(http.StatusOK)
+	varied, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/negative/varied", nil)
+	varied.Header.Set("X-Lang", "en")
+	tester.AssertResponse(varied, http.StatusOK, "Hello negative 5!")
+	handler.status.Store(http.StatusInternalServerError)
+	variant, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/negative/varied", nil)
+	variant.Header.Set("X-Lang", "fr")
+	variant.Header.Set("Cache-Control", "no-cache")
+	resp7, _ := tester.AssertResponse(variant, http.StatusInternalServerError, "Hello negative 6!")
+	if !strings.Contains(resp7.Header.Get("Cache-Status"), "; stored") {
+		t.Errorf("unexpected resp7 headers %v", resp7.Header)
+	}
+	resp8, _ := tester.AssertResponse(varied, http.StatusOK, "Hello negative 5!")
+	if !strings.HasPrefix(resp8.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected resp8 headers %v", resp8.Header)
+	}
+}
+
+type placeholderHandler struct{}
+
+func (t *placeholderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Cache-TTL", r.URL.Query().Get("ttl"))
+	_, _ = w.Write([]byte("Hello " + r.URL.Path))
+}
+
+func TestPlaceholders(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /placeholder/* {
+			cache {
+				ttl {http.reverse_proxy.header.X-Cache-TTL} 60s
+				stale {http.request.uri.query.stale} 30s
+				default_cache_control "{http.request.uri.query.cc}" public
+			}
+			reverse_proxy localhost:9100
+		}
+	}`, "caddyfile")
+
+	serveUpstream(t, ":9100", &placeholderHandler{})
+
+	ttl := func(resp *http.Response) int {
+		_, after, _ := strings.Cut(resp.Header.Get("Cache-Status"), "; ttl=")
+		value, _ := strconv.Atoi(strings.Split(after, ";")[0])
+		return value
+	}
+	get := func(uri string, hit bool) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+uri, nil)
+		resp := tester.AssertResponseCode(req, http.StatusOK)
+		if hit != strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+			t.Errorf("unexpected %s Cache-Status %s", uri, resp.Header.Get("Cache-Status"))
+		}
+		if resp.Header.Get("Cache-Handler-Stale") != "" || resp.Header.Get("Cache-Handler-Targeted-Field") != "" {
+			t.Errorf("unexpected %s headers %v", uri, resp.Header)
+		}
+		return resp
+	}
+
+	get("/placeholder/upstream?ttl=10", false)
+	if resp := get("/placeholder/upstream?ttl=10", true); ttl(resp) > 10 || resp.Header.Get("Cache-Control") != "public" {
+		t.Errorf("unexpected upstream ttl headers %v", resp.Header)
+	}
+
+	get("/placeholder/fallback?ttl=invalid", false)
+	if resp := get("/placeholder/fallback?ttl=invalid", true); ttl(resp) > 60 || ttl(resp) < 55 {
+		t.Errorf("unexpected fallback ttl headers %v", resp.Header)
+	}
+
+	get("/placeholder/cc?ttl=5&cc=max-age%3D20", false)
+	if resp := get("/placeholder/cc?ttl=5&cc=max-age%3D20", true); ttl(resp) > 20 || ttl(resp) < 15 || resp.Header.Get("Cache-Control") != "max-age=20" {
+		t.Errorf("unexpected default cache control headers %v", resp.Header)
+	}
+
+	get("/placeholder/stale?ttl=1&stale=0s", false)
+	get("/placeholder/kept?ttl=1&stale=30", false)
+	time.Sleep(2 * time.Second)
+	staleReq := func(uri string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+uri, nil)
+		req.Header.Set("Cache-Control", "max-stale=60")
+		return tester.AssertResponseCode(req, http.StatusOK)
+	}
+	if resp := staleReq("/placeholder/stale?ttl=1&stale=0s"); !strings.Contains(resp.Header.Get("Cache-Status"), "fwd=uri-miss") {
+		t.Errorf("unexpected expired stale headers %v", resp.Header)
+	}
+	if resp := staleReq("/placeholder/kept?ttl=1&stale=30"); !strings.Contains(resp.Header.Get("Cache-Status"), "fwd=stale") {
+		t.Errorf("unexpected kept stale headers %v", resp.Header)
+	}
+}
+
+type cacheTokensHandler struct {
+	iterator int32
+}
+
+func (t *cacheTokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("%d|%s|%s|%s", iteration, r.URL.RawQuery, r.Header.Get("X-Cache-Bypass"), r.Header.Get("Cookie"))))
+}
+
+func TestCacheTokens(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		route /tokens {
+			cache {
+				bypass_token {
+					header X-Cache-Bypass
+					cookie cache_bypass
+					secret s3cr3t
+				}
+				refresh_token {
+					query cache_refresh
+					secret s3cr3t
+				}
+			}
+			reverse_proxy localhost:9101
+		}
+	}`, "caddyfile")
+
+	serveUpstream(t, ":9101", &cacheTokensHandler{})
+
+	get := func(query, header, cookie, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/tokens"+query, nil)
+		if header != "" {
+			req.Header.Set("X-Cache-Bypass", header)
+		}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp, _ := tester.AssertResponse(req, http.StatusOK, body)
+		return resp
+	}
+	hit := func(resp *http.Response) bool {
+		return strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit; ttl=")
+	}
+
+	_ = get("", "", "", "1|||")
+	if resp := get("", "s3cr3t", "", "2|||"); resp.Header.Get("Cache-Status") != "Souin; fwd=bypass; detail=BYPASS-TOKEN" {
+		t.Errorf("unexpected header bypass Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("", "", "", "1|||"); !hit(resp) {
+		t.Errorf("unexpected Cache-Status after bypass %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("", "invalid", "", "1|||"); !hit(resp) {
+		t.Errorf("unexpected invalid secret Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("", "", "cache_bypass=s3cr3t; variant=a", "3|||variant=a"); resp.Header.Get("Cache-Status") != "Souin; fwd=bypass; detail=BYPASS-TOKEN" {
+		t.Errorf("unexpected cookie bypass Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+
+	resp := get("?cache_refresh=s3cr3t", "", "", "4|||")
+	if resp.Header.Get("Cache-Status") != "Souin; fwd=request; stored; key=GET-http-localhost:9080-/tokens; detail=REFRESH-TOKEN" {
+		t.Errorf("unexpected refresh Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("", "", "", "4|||"); !hit(resp) {
+		t.Errorf("unexpected Cache-Status after refresh %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("?cache_refresh=invalid", "", "", "4|||"); !hit(resp) {
+		t.Errorf("unexpected invalid refresh Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+}
+
+type cacheMatcherHandler struct {
+	iterator int32
+}
+
+func (t *cacheMatcherHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=1")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.Header.Get("X-Variant"), iteration)))
+}
+
+func TestCacheMatcher(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache {
+			stale 30s
+		}
+	}
+	localhost:9080 {
+		route /matcher {
+			@cached {
+				header X-Probe 1
+				cache cached {
+					key {
+						headers X-Variant
+					}
+				}
+			}
+			respond @cached "cached"
+			@stale {
+				header X-Probe 1
+				cache stale {
+					key {
+						headers X-Variant
+					}
+				}
+			}
+			respond @stale "stale"
+			@miss {
+				header X-Probe 1
+				cache miss {
+					key {
+						headers X-Variant
+					}
+				}
+			}
+			respond @miss "miss"
+			cache {
+				key {
+					headers X-Variant
+				}
+			}
+			reverse_proxy localhost:9102
+		}
+	}`, "caddyfile")
+
+	serveUpstream(t, ":9102", &cacheMatcherHandler{})
+
+	get := func(variant string, probe bool, body string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080/matcher", nil)
+		req.Header.Set("X-Variant", variant)
+		if probe {
+			req.Header.Set("X-Probe", "1")
+		}
+		_, _ = tester.AssertResponse(req, http.StatusOK, body)
+	}
+
+	get("a", true, "miss")
+	get("a", false, "Hello a 1!")
+	get("a", true, "cached")
+	get("b", true, "miss")
+	get("a", false, "Hello a 1!")
+
+	time.Sleep(2 * time.Second)
+	get("a", true, "stale")
+	get("b", true, "miss")
+	get("b", false, "Hello b 2!")
+}
+
+type privateCacheHandler struct {
+	iterator int32
+}
+
+func (t *privateCacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/auth" {
+		if c, err := r.Cookie("session"); err == nil {
+			w.Header().Set("X-User-Id", c.Value)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	w.Header().Set("Surrogate-Key", "dashboard")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s%s %d!", r.Header.Get("Authorization"), r.Header.Get("Cookie"), iteration)))
+}
+
+func TestPrivateCache(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache {
+			ttl 1000s
+		}
+	}
+	localhost:9080 {
+		route /private {
+			cache {
+				private
+			}
+			reverse_proxy localhost:9103
+		}
+		route /private-cookie {
+			cache {
+				private {
+					cookie session
+				}
+			}
+			reverse_proxy localhost:9103
+		}
+		route /private-auth {
+			cache {
+				private {
+					placeholder {http.request.header.X-User-Id}
+				}
+			}
+			forward_auth localhost:9103 {
+				uri /auth
+				copy_headers X-User-Id
+			}
+			reverse_proxy localhost:9103
+		}
+	}`, "caddyfile")
+
+	serveUpstream(t, ":9103", &privateCacheHandler{})
+
+	get := func(path string, header http.Header, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+path, nil)
+		req.Header = header
+		resp, _ := tester.AssertResponse(req, http.StatusOK, body)
+		if resp.Header.Get("Cache-Control") != "private, max-age=60" || resp.Header.Get("Surrogate-Key") != "dashboard" ||
+			resp.Header.Get("Cache-Handler-Targeted-Field") != "" || resp.Header.Get("Cache-Handler-Original-Cache-Control") != "" {
+			t.Errorf("unexpected %s headers %v", path, resp.Header)
+		}
+		return resp
+	}
+	alice := http.Header{"Authorization": []string{"Bearer alice"}}
+	bob := http.Header{"Authorization": []string{"Bearer bob"}}
+
+	resp := get("/private", alice, "Hello Bearer alice 1!")
+	if resp.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/private-"+identityHash("Bearer alice") {
+		t.Errorf("unexpected alice Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	if resp := get("/private", alice, "Hello Bearer alice 1!"); !strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected alice hit Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	_ = get("/private", bob, "Hello Bearer bob 2!")
+	if resp := get("/private", bob, "Hello Bearer bob 2!"); !strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected bob hit Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	spoofed := http.Header{"Cache-Handler-Private": []string{identityHash("Bearer alice")}}
+	if resp := get("/private", spoofed, "Hello  3!"); !strings.Contains(resp.Header.Get("Cache-Status"), "detail=PRIVATE-OR-AUTHENTICATED-RESPONSE") {
+		t.Errorf("unexpected anonymous Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+
+	_ = get("/private-cookie", http.Header{"Cookie": []string{"session=alice"}}, "Hello session=alice 4!")
+	_ = get("/private-cookie", http.Header{"Cookie": []string{"session=alice"}}, "Hello session=alice 4!")
+	_ = get("/private-cookie", http.Header{"Cookie": []string{"session=bob"}}, "Hello session=bob 5!")
+
+	// The surrogate keys are stored asynchronously.
+	time.Sleep(100 * time.Millisecond)
+	purgeRq, _ := http.NewRequest(http.MethodPost, "http://localhost:2999/cache/private/purge", strings.NewReader(`{"identity":"Bearer alice"}`))
+	tester.AssertResponseCode(purgeRq, http.StatusNoContent)
+	invalidRq, _ := http.NewRequest(http.MethodPost, "http://localhost:2999/cache/private/purge", strings.NewReader(`{}`))
+	tester.AssertResponseCode(invalidRq, http.StatusBadRequest)
+
+	_ = get("/private", alice, "Hello Bearer alice 6!")
+	if resp := get("/private", bob, "Hello Bearer bob 2!"); !strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit; ttl=") {
+		t.Errorf("unexpected bob Cache-Status after purge %v", resp.Header.Get("Cache-Status"))
+	}
+	_ = get("/private-cookie", http.Header{"Cookie": []string{"session=alice"}}, "Hello session=alice 4!")
+
+	// The user is only identified by forward_auth after the key is built,
+	// the responses stay private and are never shared.
+	_ = get("/private-auth", http.Header{"Cookie": []string{"session=alice"}}, "Hello session=alice 7!")
+	if resp := get("/private-auth", http.Header{"Cookie": []string{"session=bob"}}, "Hello session=bob 8!"); strings.Contains(resp.Header.Get("Cache-Status"), "; hit;") {
+		t.Errorf("unexpected forward_auth bob Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+}
+
+type poisoningHandler struct {
+	iterator int32
+}
+
+func (t *poisoningHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iteration := atomic.AddInt32(&t.iterator, 1)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.WriteHeader(http.StatusOK)
+	if strings.HasSuffix(r.URL.Path, "-safe") {
+		_, _ = w.Write([]byte("Hello safe!"))
+		return
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.Header.Get("X-Original-URL"), iteration)))
+}
+
+func TestPoisoningProtection(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "cache.log")
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`
+	{
+		admin localhost:2999
+		http_port     9080
+		log {
+			output file %s
+			format json
+		}
+		cache
+	}
+	localhost:9080 {
+		route /poisoning-strip {
+			cache {
+				poisoning_protection
+			}
+			reverse_proxy localhost:9104
+		}
+		route /poisoning-key {
+			cache {
+				poisoning_protection {
+					mode key
+					headers X-Original-URL
+				}
+			}
+			reverse_proxy localhost:9104
+		}
+		route /poisoning-detect* {
+			cache {
+				poisoning_protection {
+					mode detect
+				}
+			}
+			reverse_proxy localhost:9104
+		}
+	}`, logFile), "caddyfile")
+
+	serveUpstream(t, ":9104", &poisoningHandler{})
+
+	get := func(path, original string, noCache bool, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+path, nil)
+		if original != "" {
+			req.Header.Set("X-Original-URL", original)
+		}
+		if noCache {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		resp, _ := tester.AssertResponse(req, http.StatusOK, body)
+		return resp
+	}
+
+	_ = get("/poisoning-strip", "/admin", false, "Hello  1!")
+	_ = get("/poisoning-strip", "", false, "Hello  1!")
+
+	resp := get("/poisoning-key", "/admin", false, "Hello /admin 2!")
+	if resp.Header.Get("Cache-Status") != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/poisoning-key-/admin" {
+		t.Errorf("unexpected key Cache-Status %v", resp.Header.Get("Cache-Status"))
+	}
+	_ = get("/poisoning-key", "", false, "Hello  3!")
+	_ = get("/poisoning-key", "/admin", false, "Hello /admin 2!")
+
+	readLog := func() string {
+		time.Sleep(100 * time.Millisecond)
+		content, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatalf("unable to read the log file: %v", err)
+		}
+		return string(content)
+	}
+
+	_ = get("/poisoning-detect-safe", "/a", false, "Hello safe!")
+	_ = get("/poisoning-detect-safe", "/b", true, "Hello safe!")
+	if strings.Contains(readLog(), "Possible cache poisoning") {
+		t.Errorf("unexpected poisoning detection for the same response")
+	}
+	_ = get("/poisoning-detect", "/a", false, "Hello /a 6!")
+	_ = get("/poisoning-detect", "/b", false, "Hello /a 6!")
+	_ = get("/poisoning-detect", "/b", true, "Hello /b 7!")
+	if content := readLog(); !strings.Contains(content, "Possible cache poisoning of GET-http-localhost:9080-/poisoning-detect") {
+		t.Errorf("expected a poisoning detection in the log %s", content)
+	}
+}
+
+type coalescingHandler struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (t *coalescingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	t.calls[r.URL.Path]++
+	call := t.calls[r.URL.Path]
+	t.mu.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+	switch {
+	case strings.HasSuffix(r.URL.Path, "-uncacheable"):
+		w.Header().Set("Cache-Control", "no-store")
+	case strings.HasSuffix(r.URL.Path, "-retry") && call == 1,
+		strings.HasSuffix(r.URL.Path, "-stale") && call > 1,
+		strings.HasSuffix(r.URL.Path, "-error"):
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("Upstream failure"))
+		return
+	case strings.HasSuffix(r.URL.Path, "-stale"):
+		w.Header().Set("Cache-Control", "max-age=1")
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello %s %d!", r.URL.Path, call)))
+}
+
+func (t *coalescingHandler) called(path string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.calls[path]
+}
+
+func TestCoalescing(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache {
+			stale 1m
+		}
+	}
+	localhost:9080 {
+		route /coalescing-shared {
+			cache {
+				coalescing
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-timeout {
+			cache {
+				coalescing {
+					timeout 100ms
+				}
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-waiters {
+			cache {
+				coalescing {
+					max_waiters 1
+				}
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-uncacheable {
+			cache {
+				coalescing
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-oversized {
+			cache {
+				coalescing
+				max_cacheable_body_bytes 5
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-shared-uncacheable {
+			cache {
+				coalescing {
+					uncacheable
+				}
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-retry {
+			cache {
+				coalescing {
+					on_error retry
+				}
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-stale {
+			cache {
+				coalescing {
+					on_error stale
+				}
+			}
+			reverse_proxy localhost:9105
+		}
+		route /coalescing-error {
+			cache {
+				coalescing {
+					on_error error
+				}
+			}
+			reverse_proxy localhost:9105
+		}
+	}`, "caddyfile")
+
+	upstream := &coalescingHandler{calls: map[string]int{}}
+	serveUpstream(t, ":9105", upstream)
+
+	type result struct {
+		status int
+		body   string
+		cache  string
+	}
+	// burst sends a first request then the concurrent ones while the first
+	// one is still waiting for the upstream response.
+	burst := func(path string, count int) []result {
+		results := make([]result, count)
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := http.Get("http://localhost:9080" + path)
+				if err != nil {
+					t.Errorf("unexpected error for %s: %v", path, err)
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				results[i] = result{status: resp.StatusCode, body: string(body), cache: resp.Header.Get("Cache-Status")}
+			}(i)
+			if i == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		wg.Wait()
+
+		return results
+	}
+
+	results := burst("/coalescing-shared", 4)
+	if upstream.called("/coalescing-shared") != 1 {
+		t.Errorf("unexpected upstream calls for the coalesced requests: %d", upstream.called("/coalescing-shared"))
+	}
+	if results[0].cache != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/coalescing-shared" {
+		t.Errorf("unexpected leader Cache-Status: %s", results[0].cache)
+	}
+	for _, res := range results[1:] {
+		if res.body != "Hello /coalescing-shared 1!" || res.cache != "Souin; fwd=uri-miss; key=GET-http-localhost:9080-/coalescing-shared; detail=COALESCED" {
+			t.Errorf("unexpected coalesced response %+v", res)
+		}
+	}
+
+	_ = burst("/coalescing-timeout", 2)
+	if upstream.called("/coalescing-timeout") != 2 {
+		t.Errorf("unexpected upstream calls after the coalescing timeout: %d", upstream.called("/coalescing-timeout"))
+	}
+
+	_ = burst("/coalescing-waiters", 3)
+	if upstream.called("/coalescing-waiters") != 2 {
+		t.Errorf("unexpected upstream calls over the waiters limit: %d", upstream.called("/coalescing-waiters"))
+	}
+
+	_ = burst("/coalescing-uncacheable", 3)
+	if upstream.called("/coalescing-uncacheable") != 3 {
+		t.Errorf("unexpected upstream calls for the uncacheable response: %d", upstream.called("/coalescing-uncacheable"))
+	}
+	// The response is not shared when it has not been stored.
+	_ = burst("/coalescing-oversized", 3)
+	if upstream.called("/coalescing-oversized") != 3 {
+		t.Errorf("unexpected upstream calls for the response too large to be stored: %d", upstream.called("/coalescing-oversized"))
+	}
+	results = burst("/coalescing-shared-uncacheable", 3)
+	if upstream.called("/coalescing-shared-uncacheable") != 1 {
+		t.Errorf("unexpected upstream calls for the shared uncacheable response: %d", upstream.called("/coalescing-shared-uncacheable"))
+	}
+	for _, res := range results {
+		if res.body != "Hello /coalescing-shared-uncacheable 1!" {
+			t.Errorf("unexpected shared uncacheable response %+v", res)
+		}
+	}
+
+	results = burst("/coalescing-retry", 3)
+	if upstream.called("/coalescing-retry") != 2 {
+		t.Errorf("unexpected upstream calls on the leader retry: %d", upstream.called("/coalescing-retry"))
+	}
+	if results[0].status != http.StatusInternalServerError {
+		t.Errorf("unexpected leader response %+v", results[0])
+	}
+	for _, res := range results[1:] {
+		if res.status != http.StatusOK || res.body != "Hello /coalescing-retry 2!" {
+			t.Errorf("unexpected retried response %+v", res)
+		}
+	}
+
+	_ = burst("/coalescing-stale", 1)
+	time.Sleep(1500 * time.Millisecond)
+	results = burst("/coalescing-stale", 3)
+	if upstream.called("/coalescing-stale") != 2 {
+		t.Errorf("unexpected upstream calls on the stale fallback: %d", upstream.called("/coalescing-stale"))
+	}
+	for _, res := range results[1:] {
+		if res.status != http.StatusOK || res.body != "Hello /coalescing-stale 1!" ||
+			!strings.Contains(res.cache, "; fwd=stale; detail=COALESCING-LEADER-FAILED") {
+			t.Errorf("unexpected stale response %+v", res)
+		}
+	}
+
+	results = burst("/coalescing-error", 3)
+	if upstream.called("/coalescing-error") != 1 {
+		t.Errorf("unexpected upstream calls on the leader error: %d", upstream.called("/coalescing-error"))
+	}
+	for _, res := range results {
+		if res.status != http.StatusInternalServerError || res.body != "Upstream failure" {
+			t.Errorf("unexpected shared error response %+v", res)
+		}
+	}
+}
+
+// fakeRedis implements the commands of the Redis lock backend.
+type fakeRedis struct {
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	if expires, ok := f.expires[key]; ok && time.Now().After(expires) {
+		delete(f.values, key)
+		delete(f.expires, key)
+	}
+	value, ok := f.values[key]
+
+	return value, ok
+}
+
+func (f *fakeRedis) set(key, value string, ms string) {
+	d, _ := strconv.Atoi(ms)
+	f.values[key] = value
+	f.expires[key] = time.Now().Add(time.Duration(d) * time.Millisecond)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			_, _ = reader.ReadString('\n')
+			arg, _ := reader.ReadString('\n')
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+
+		f.mu.Lock()
+		reply := ":0\r\n"
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			// SET key value PX|EX lease NX
+			lease := args[4]
+			if strings.EqualFold(args[3], "EX") {
+				seconds, _ := strconv.Atoi(lease)
+				lease = strconv.Itoa(seconds * 1000)
+			}
+			reply = "$-1\r\n"
+			if _, held := f.get(args[1]); !held {
+				f.set(args[1], args[2], lease)
+				reply = "+OK\r\n"
+			}
+		case "EVAL":
+			if owner, _ := f.get(args[3]); owner == args[4] {
+				if strings.Contains(args[1], "pexpire") {
+					f.set(args[3], owner, args[5])
+				} else {
+					delete(f.values, args[3])
+				}
+				reply = ":1\r\n"
+			}
+		default:
+			// The client falls back to RESP2 without the HELLO command.
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		_, _ = conn.Write([]byte(reply))
+	}
+}
+
+func TestDistributedCoalescing(t *testing.T) {
+	redis := &fakeRedis{values: map[string]string{}, expires: map[string]time.Time{}}
+	listener, err := net.Listen("tcp", "localhost:9107")
+	if err != nil {
+		t.Fatalf("unable to start the fake redis server: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go redis.serve(conn)
+		}
+	}()
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache
+	}
+	localhost:9080 {
+		@node_b header X-Node b
+		route @node_b {
+			cache {
+				coalescing {
+					distributed {
+						poll 50ms
+					}
+				}
+			}
+			reverse_proxy localhost:9106
+		}
+		@node_c header X-Node c
+		route @node_c {
+			cache {
+				coalescing {
+					distributed {
+						lease 900ms
+						poll 50ms
+						redis redis://localhost:9107/0
+					}
+				}
+			}
+			reverse_proxy localhost:9106
+		}
+		route /distributed-redis* {
+			cache {
+				coalescing {
+					distributed {
+						lease 900ms
+						poll 50ms
+						redis redis://localhost:9107/0
+					}
+				}
+			}
+			reverse_proxy localhost:9106
+		}
+		route /distributed-storer {
+			cache {
+				coalescing {
+					distributed {
+						poll 50ms
+					}
+				}
+			}
+			reverse_proxy localhost:9106
+		}
+	}`, "caddyfile")
+
+	upstream := &coalescingHandler{calls: map[string]int{}}
+	serveUpstream(t, ":9106", upstream)
+
+	// nodes sends the request to the first node then to the second one while
+	// the first one is still waiting for the upstream response.
+	nodes := func(path string, second string) []*http.Response {
+		responses := make([]*http.Response, 2)
+		var wg sync.WaitGroup
+		for i, node := range []string{"a", second} {
+			wg.Add(1)
+			go func(i int, node string) {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodGet, "http://localhost:9080"+path, nil)
+				req.Header.Set("X-Node", node)
+				responses[i], _ = tester.AssertResponse(req, http.StatusOK, fmt.Sprintf("Hello %s 1!", path))
+			}(i, node)
+			time.Sleep(100 * time.Millisecond)
+		}
+		wg.Wait()
+		for i, resp := range responses {
+			if resp == nil {
+				t.Fatalf("no response from the node %d for %s", i, path)
+			}
+		}
+
+		return responses
+	}
+
+	responses := nodes("/distributed-storer", "b")
+	if upstream.called("/distributed-storer") != 1 {
+		t.Errorf("unexpected upstream calls for the nodes sharing the storer: %d", upstream.called("/distributed-storer"))
+	}
+	if status := responses[1].Header.Get("Cache-Status"); !strings.HasPrefix(status, "Souin; hit; ttl=") {
+		t.Errorf("unexpected Cache-Status of the waiting node: %s", status)
+	}
+
+	responses = nodes("/distributed-redis", "c")
+	if upstream.called("/distributed-redis") != 1 {
+		t.Errorf("unexpected upstream calls with the redis lock: %d", upstream.called("/distributed-redis"))
+	}
+	if status := responses[1].Header.Get("Cache-Status"); !strings.HasPrefix(status, "Souin; hit; ttl=") {
+		t.Errorf("unexpected Cache-Status of the request waiting for the redis lock: %s", status)
+	}
+	redis.mu.Lock()
+	if len(redis.values) != 0 {
+		t.Errorf("unexpected redis locks after the responses are stored: %v", redis.values)
+	}
+	// A crashed node still holds the lock until its lease expires.
+	redis.set("COALESCING_LOCK_GET-http-localhost:9080-/distributed-redis-expired", "crashed", "600")
+	redis.mu.Unlock()
+
+	start := time.Now()
+	resp, _ := tester.AssertGetResponse("http://localhost:9080/distributed-redis-expired", http.StatusOK, "Hello /distributed-redis-expired 1!")
+	if resp == nil {
+		t.Fatal("no response after the lease expiry")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("unexpected response before the lease expiry: %s", elapsed)
+	}
+	if status := resp.Header.Get("Cache-Status"); status != "Souin; fwd=uri-miss; stored; key=GET-http-localhost:9080-/distributed-redis-expired" {
+		t.Errorf("unexpected Cache-Status after the lease expiry: %s", status)
+	}
+}
+
+func TestPurgeBus(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		admin localhost:2999
+		http_port     9080
+		cache {
+			api {
+				souin
+			}
+			purge_bus {
+				memory
+				channel purge-bus-test
+				node node-a
+			}
+		}
+	}
+	localhost:9080 {
+		route /purge-bus-* {
+			cache
+			header Surrogate-Key "{path}"
+			respond "Hello purge bus!"
+		}
+	}`, "caddyfile")
+
+	// The peer is another node on the in-process bus.
+	events := make(chan purgeEvent, 10)
+	peer := newMemoryTransport("purge-bus-test")
+	defer peer.close()
+	go func() {
+		_ = peer.listen(func(payload []byte) {
+			var e purgeEvent
+			_ = json.Unmarshal(payload, &e)
+			events <- e
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	received := func() purgeEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no purge event published")
+		}
+		return purgeEvent{}
+	}
+	peerPurge := func(e purgeEvent) {
+		payload, _ := json.Marshal(e)
+		_ = peer.publish(payload)
+		// The event published by the peer is received by the peer as well.
+		_ = received()
+	}
+	cached := func(path string) bool {
+		resp, _ := tester.AssertGetResponse("http://localhost:9080"+path, http.StatusOK, "Hello purge bus!")
+		return strings.HasPrefix(resp.Header.Get("Cache-Status"), "Souin; hit; ttl=")
+	}
+
+	_ = cached("/purge-bus-a")
+	_ = cached("/purge-bus-b")
+	// The surrogate keys are stored asynchronously.
+	time.Sleep(100 * time.Millisecond)
+	if !cached("/purge-bus-a") || !cached("/purge-bus-b") {
+		t.Fatal("the responses are not cached")
+	}
+
+	event := purgeEvent{ID: "event-1", Node: "node-b", Time: time.Now(), Kind: purgeEventAPI, Method: "PURGE", Header: http.Header{"Surrogate-Key": []string{"/purge-bus-a"}}}
+	peerPurge(event)
+	if cached("/purge-bus-a") {
+		t.Error("the response purged by the peer is still cached")
+	}
+	if !cached("/purge-bus-b") {
+		t.Error("unexpected purge of the response not tagged with the purged surrogate key")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !cached("/purge-bus-a") {
+		t.Error("the response is not cached again")
+	}
+	// The redelivered event is not applied again.
+	peerPurge(event)
+	if !cached("/purge-bus-a") {
+		t.Error("the redelivered event has been applied twice")
+	}
+
+	purgeRq, _ := http.NewRequest("PURGE", "http://localhost:2999/souin-api/souin/GET-http-localhost:9080-/purge-bus-b", nil)
+	purgeRq.Header.Set("Cache-Purge-Event-Id", "event-2")
+	tester.AssertResponseCode(purgeRq, http.StatusNoContent)
+	if e := received(); e.ID != "event-2" || e.Node != "node-a" || e.Kind != purgeEventAPI || e.Method != "PURGE" || e.URI != "/GET-http-localhost:9080-/purge-bus-b" {
+		t.Errorf("unexpected purge event %+v", e)
+	}
+	if cached("/purge-bus-b") {
+		t.Error("the response is still cached after the purge")
+	}
+	privateRq, _ := http.NewRequest(http.MethodPost, "http://localhost:2999/cache/private/purge", strings.NewReader(`{"identity":"Bearer alice"}`))
+	tester.AssertResponseCode(privateRq, http.StatusNoContent)
+	if e := received(); e.Node != "node-a" || e.Kind != purgeEventPrivate || e.Hash != identityHash("Bearer alice") || e.ID == "" {
+		t.Errorf("unexpected private purge event %+v", e)
+	}
+
+	statusRq, _ := http.NewRequest(http.MethodGet, "http://localhost:2999/cache/purge_bus/status", nil)
+	resp := tester.AssertResponseCode(statusRq, http.StatusOK)
+	var status purgeBusStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("unable to decode the purge bus status: %v", err)
+	}
+	peerStatus := status.Peers["node-b"]
+	if status.Node != "node-a" || status.Backend != "memory" || status.Channel != "purge-bus-test" || status.Published != 2 || status.Duplicates != 1 ||
+		len(status.Peers) != 1 || peerStatus.LastEventID != "event-1" || peerStatus.Applied != 1 || peerStatus.Failed != 0 || !peerStatus.LastEventTime.Equal(event.Time) {
+		t.Errorf("unexpected purge bus status %+v", status)
+	}
+}
+
+func TestParseConfigurationArguments(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"refresh_ahead threshold without value", "refresh_ahead {\n threshold\n }", "wrong argument count"},
+		{"refresh_ahead invalid threshold", "refresh_ahead {\n threshold 120%\n }", "invalid refresh_ahead threshold: 120%"},
+		{"refresh_ahead min_hits without value", "refresh_ahead {\n min_hits\n }", "wrong argument count"},
+		{"refresh_ahead invalid min_hits", "refresh_ahead {\n min_hits -1\n }", "invalid refresh_ahead min_hits: -1"},
+		{"negative_ttl status without lifetime", "negative_ttl {\n 404\n }", "wrong argument count"},
+		{"negative_ttl preserve_positive with value", "negative_ttl {\n preserve_positive 404\n }", "wrong argument count"},
+		{"stale_while_revalidate workers without value", "stale_while_revalidate {\n workers\n }", "wrong argument count"},
+		{"stale_while_revalidate invalid workers", "stale_while_revalidate {\n workers 0\n }", "invalid stale_while_revalidate workers: 0"},
+		{"stale_while_revalidate queue without value", "stale_while_revalidate {\n queue\n }", "wrong argument count"},
+		{"stale_while_revalidate invalid queue", "stale_while_revalidate {\n queue many\n }", "invalid stale_while_revalidate queue: many"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := caddyfile.NewTestDispenser("cache {\n" + tc.input + "\n}")
+			err := parseConfiguration(&Configuration{}, h, true)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("unexpected error %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestRevalidatorStop(t *testing.T) {
+	rv := newRevalidator(&StaleWhileRevalidate{Workers: 1, Queue: 2})
+	block := make(chan struct{})
+	defer close(block)
+	rv.schedule("running", func() { <-block })
+	time.Sleep(50 * time.Millisecond)
+	if !rv.schedule("queued", func() {}) {
+		t.Fatal("the refresh has not been queued")
+	}
+
+	rv.stop()
+	if rv.schedule("stopped", func() {}) {
+		t.Error("the refresh has been scheduled after the stop")
+	}
+	for _, key := range []string{"queued", "stopped"} {
+		if _, pending := rv.inflight.Load(key); pending {
+			t.Errorf("the refresh of %s is still pending after the stop", key)
+		}
+	}
+}
+
+func TestStatsEntriesCap(t *testing.T) {
+	st := newStats()
+	keys := make(map[string]entryOwner, maxStatsEntries)
+	for i := 0; i < maxStatsEntries; i++ {
+		keys[strconv.Itoa(i)] = entryOwner{host: "localhost"}
+	}
+	st.entries["DEFAULT"] = keys
+
+	st.addEntry("DEFAULT", "new", "localhost", "srv0/route")
+	st.addEntry("DEFAULT", "0", "localhost", "srv0/route")
+	if _, ok := st.entries["DEFAULT"]["new"]; ok {
+		t.Error("the owner of a new key has been recorded over the cap")
+	}
+	if owner := st.entries["DEFAULT"]["0"]; owner.route != "srv0/route" {
+		t.Errorf("the owner of a recorded key has not been updated: %+v", owner)
+	}
+
+	st.removeEntry("DEFAULT", "1")
+	st.addEntry("DEFAULT", "new", "localhost", "srv0/route")
+	if _, ok := st.entries["DEFAULT"]["new"]; !ok {
+		t.Error("the owner of a new key has not been recorded under the cap")
+	}
+}
@@ -0,0 +1,146 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/darkweak/souin/pkg/storage/types"
+	"github.com/darkweak/storages/core"
+)
+
+// isSafeMethod returns whether the method is safe as defined in RFC 9110
+// section 9.2.1.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+// requestURL returns the absolute URL of the request.
+func requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = r.Host
+
+	return &u
+}
+
+// targetKeys computes the cache keys of a GET request to the target URL
+// sent with the same headers as the request.
+func (s *SouinCaddyMiddleware) targetKeys(r *http.Request, target *url.URL) (key string, storageKey string) {
+	rq := r.Clone(r.Context())
+	rq.Method = http.MethodGet
+	rq.URL = &url.URL{Path: target.Path, RawPath: target.RawPath, RawQuery: target.RawQuery}
+	rq.Host = target.Host
+	rq.RequestURI = rq.URL.RequestURI()
+	rq.Body = http.NoBody
+	rq.ContentLength = 0
+
+	return s.cacheKey(rq)
+}
+
+// invalidationTargets returns the request URL and the Location and
+// Content-Location targets of the response on the same origin.
+func invalidationTargets(r *http.Request, header http.Header) []*url.URL {
+	base := requestURL(r)
+	targets := []*url.URL{base}
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		target, err := base.Parse(value)
+		if err != nil || target.Scheme != base.Scheme || !strings.EqualFold(target.Host, base.Host) {
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// invalidateUnsafe removes every variant of the cached responses of the
+// request URL and of the Location and Content-Location targets after a
+// successful unsafe request, as required by RFC 9111 section 4.4.
+func (s *SouinCaddyMiddleware) invalidateUnsafe(r *http.Request, header http.Header, status int) {
+	if isSafeMethod(r.Method) || status < http.StatusOK || status >= http.StatusBadRequest {
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, target := range invalidationTargets(r, header) {
+		_, storageKey := s.targetKeys(r, target)
+		if storageKey == "" || seen[storageKey] {
+			continue
+		}
+		seen[storageKey] = true
+		for _, storer := range s.SouinBaseHandler.Storers {
+			purgeVariants(storer, storageKey)
+		}
+	}
+}
+
+// purgeVariants removes the stored variants of the key and their mapping.
+func purgeVariants(storer types.Storer, storageKey string) {
+	if b := storer.Get(core.MappingKeyPrefix + storageKey); len(b) > 0 {
+		if mapping, err := core.DecodeMapping(b); err == nil {
+			for variant := range mapping.GetMapping() {
+				storer.Delete(variant)
+			}
+		}
+	}
+	storer.Delete(core.MappingKeyPrefix + storageKey)
+	storer.Delete(storageKey)
+}
+
+// keptMappings lists the mappings the Souin base handler must not delete.
+type keptMappings struct {
+	mu   sync.Mutex
+	keys map[string]int
+}
+
+func newKeptMappings() *keptMappings {
+	return &keptMappings{keys: map[string]int{}}
+}
+
+// keep protects the mapping until the returned function is called.
+func (k *keptMappings) keep(mapping string) func() {
+	k.mu.Lock()
+	k.keys[mapping]++
+	k.mu.Unlock()
+
+	return func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.keys[mapping]--; k.keys[mapping] <= 0 {
+			delete(k.keys, mapping)
+		}
+	}
+}
+
+func (k *keptMappings) kept(mapping string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.keys[mapping] > 0
+}
+
+// keepMapping prevents the Souin base handler from invalidating the cached
+// responses of the request URL when the unsafe invalidation is disabled, the
+// returned function must be called once the request is handled.
+func (s *SouinCaddyMiddleware) keepMapping(r *http.Request) func() {
+	key, _ := s.targetKeys(r, requestURL(r))
+	if key == "" {
+		return func() {}
+	}
+
+	return s.keptMappings.keep(core.MappingKeyPrefix + key)
+}
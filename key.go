@@ -0,0 +1,40 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+
+	xxhash "github.com/cespare/xxhash/v2"
+	souinctx "github.com/darkweak/souin/context"
+)
+
+// newKeyContext prepares the Souin contexts involved in the cache key
+// computation, it must be called once the configuration is complete.
+func newKeyContext(c *Configuration) *souinctx.Context {
+	ctx := souinctx.GetContext()
+	ctx.GraphQL.SetupContext(c)
+	ctx.Key.SetupContext(c)
+
+	return ctx
+}
+
+// cacheKey computes the cache key of the request the same way the Souin
+// base handler does, and returns the key used by the storers.
+func (s *SouinCaddyMiddleware) cacheKey(r *http.Request) (key string, storageKey string) {
+	r = s.keyRequest(r)
+	rq := s.keyContext.SetContext(r, r)
+
+	return storageKeyFromContext(rq)
+}
+
+// storageKeyFromContext returns the cache key set in the request context
+// by the Souin base handler and the key used by the storers.
+func storageKeyFromContext(r *http.Request) (key string, storageKey string) {
+	key, _ = r.Context().Value(souinctx.Key).(string)
+	storageKey = key
+	if hashed, _ := r.Context().Value(souinctx.Hashed).(bool); hashed && key != "" {
+		storageKey = fmt.Sprint(xxhash.Sum64String(key))
+	}
+
+	return key, storageKey
+}
@@ -0,0 +1,257 @@
+package httpcache
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/darkweak/souin/pkg/storage/types"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultLockLease = 10 * time.Second
+	defaultLockPoll  = 100 * time.Millisecond
+
+	// lockKeyPrefix prefixes the storage key of the lock of a key.
+	lockKeyPrefix = "COALESCING_LOCK_"
+
+	lockAcquired = "acquired"
+	lockWaited   = "waited"
+	lockTimeout  = "timeout"
+	lockError    = "error"
+)
+
+// lockBackend stores the locks shared by the nodes of the cluster.
+type lockBackend interface {
+	// acquire takes the lock of the key for the lease unless another owner
+	// holds it.
+	acquire(key, owner string, lease time.Duration) (bool, error)
+	// extend renews the lease of the lock held by the owner.
+	extend(key, owner string, lease time.Duration) (bool, error)
+	// release frees the lock held by the owner.
+	release(key, owner string) error
+	close() error
+}
+
+// distributedLock makes a single node of the cluster fetch a key from the
+// upstream while the other ones wait for the entry it stores.
+type distributedLock struct {
+	backend lockBackend
+	lease   time.Duration
+	wait    time.Duration
+	poll    time.Duration
+}
+
+// newDistributedLock stores the locks in the Redis server when configured,
+// in the first storer otherwise.
+func newDistributedLock(cfg *DistributedCoalescing, storers []types.Storer) (*distributedLock, error) {
+	l := &distributedLock{
+		lease: cfg.Lease.Duration,
+		wait:  cfg.Wait.Duration,
+		poll:  cfg.Poll.Duration,
+	}
+	if l.lease <= 0 {
+		l.lease = defaultLockLease
+	}
+	if l.wait <= 0 {
+		l.wait = l.lease
+	}
+	if l.poll <= 0 {
+		l.poll = defaultLockPoll
+	}
+
+	if cfg.Redis != "" {
+		backend, err := newRedisLock(cfg.Redis)
+		if err != nil {
+			return nil, err
+		}
+		l.backend = backend
+
+		return l, nil
+	}
+	if len(storers) == 0 {
+		return nil, errors.New("the distributed coalescing requires a storer or a redis lock backend")
+	}
+	storer := storers[0]
+	if instrumented, ok := storer.(*instrumentedStorer); ok {
+		storer = instrumented.Storer
+	}
+	l.backend = &storerLock{storer: storer}
+
+	return l, nil
+}
+
+// hold renews the lease of the acquired lock until the returned function
+// releases it. The lease expires when the node stops, the other nodes then
+// take over.
+func (l *distributedLock) hold(key, owner string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if held, err := l.backend.extend(key, owner, l.lease); err != nil || !held {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			_ = l.backend.release(key, owner)
+		})
+	}
+}
+
+// fetchLocked fetches the key once the cluster lock is acquired, or replays
+// the entry stored by the node holding it. The request is forwarded when the
+// lock can't be acquired before the wait duration.
+func (s *SouinCaddyMiddleware) fetchLocked(rw http.ResponseWriter, rq *http.Request, state *coalescingState, fetch func(http.ResponseWriter) error) error {
+	l := s.locks
+	if l == nil || isRefresh(rq.Context()) {
+		return fetch(rw)
+	}
+	// The no-cache requests refresh the stored entry.
+	if requestCc, err := cacheobject.ParseRequestCacheControl(rq.Header.Get("Cache-Control")); err != nil || requestCc.NoCache {
+		return fetch(rw)
+	}
+
+	_, storageKey := storageKeyFromContext(rq)
+	key, owner := lockKeyPrefix+storageKey, rand.Text()
+	deadline := time.Now().Add(l.wait)
+	waited := false
+	for {
+		acquired, err := l.backend.acquire(key, owner, l.lease)
+		if err != nil {
+			s.logger.Warnf("Unable to acquire the coalescing lock of %s: %v", storageKey, err)
+			s.observeCoalescingLock(rq, lockError)
+
+			return fetch(rw)
+		}
+		// The previous owner may have stored the entry since the last poll.
+		if acquired && waited && s.replayStored(rw, rq, state, false) {
+			_ = l.backend.release(key, owner)
+			s.observeCoalescingLock(rq, lockWaited)
+
+			return nil
+		}
+		if acquired {
+			s.observeCoalescingLock(rq, lockAcquired)
+			// The lock is released once the response is stored.
+			state.setUnlock(l.hold(key, owner))
+
+			return fetch(rw)
+		}
+		if !time.Now().Before(deadline) {
+			s.logger.Debugf("Coalescing lock of %s still held after %s, forward the request", storageKey, l.wait)
+			s.observeCoalescingLock(rq, lockTimeout)
+
+			return fetch(rw)
+		}
+
+		timer := time.NewTimer(l.poll)
+		select {
+		case <-rq.Context().Done():
+			timer.Stop()
+
+			return rq.Context().Err()
+		case <-timer.C:
+		}
+		waited = true
+		if s.replayStored(rw, rq, state, false) {
+			s.observeCoalescingLock(rq, lockWaited)
+
+			return nil
+		}
+	}
+}
+
+// storerLock stores the locks in the storer. The storers have no atomic
+// set-if-absent, the lock is held when the owner read back is the one
+// written. It is best-effort: two nodes reading the absent lock at once may
+// both fetch the key, only the redis lock backend is exclusive.
+type storerLock struct {
+	storer types.Storer
+}
+
+func (l *storerLock) acquire(key, owner string, lease time.Duration) (bool, error) {
+	if current := l.storer.Get(key); len(current) > 0 && string(current) != owner {
+		return false, nil
+	}
+	if err := l.storer.Set(key, []byte(owner), lease); err != nil {
+		return false, err
+	}
+
+	return string(l.storer.Get(key)) == owner, nil
+}
+
+func (l *storerLock) extend(key, owner string, lease time.Duration) (bool, error) {
+	if string(l.storer.Get(key)) != owner {
+		return false, nil
+	}
+
+	return true, l.storer.Set(key, []byte(owner), lease)
+}
+
+func (l *storerLock) release(key, owner string) error {
+	if string(l.storer.Get(key)) == owner {
+		l.storer.Delete(key)
+	}
+
+	return nil
+}
+
+func (l *storerLock) close() error {
+	return nil
+}
+
+const (
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisExtendScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// redisLock stores the locks in a Redis server with the atomic SET NX PX
+// command, the locks are only released and extended by their owner.
+type redisLock struct {
+	client *redis.Client
+}
+
+func newRedisLock(address string) (*redisLock, error) {
+	client, err := newRedisClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisLock{client: client}, nil
+}
+
+func (l *redisLock) acquire(key, owner string, lease time.Duration) (bool, error) {
+	return l.client.SetNX(context.Background(), key, owner, lease).Result()
+}
+
+func (l *redisLock) extend(key, owner string, lease time.Duration) (bool, error) {
+	extended, err := l.client.Eval(context.Background(), redisExtendScript, []string{key}, owner, lease.Milliseconds()).Int()
+
+	return extended == 1, err
+}
+
+func (l *redisLock) release(key, owner string) error {
+	return l.client.Eval(context.Background(), redisReleaseScript, []string{key}, owner).Err()
+}
+
+func (l *redisLock) close() error {
+	return l.client.Close()
+}
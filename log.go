@@ -0,0 +1,75 @@
+package httpcache
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	logFieldOutcome        = "outcome"
+	logFieldKey            = "key"
+	logFieldStorer         = "storer"
+	logFieldBackendLatency = "backend_latency"
+	logFieldStoredSize     = "stored_size"
+)
+
+// availableLogFields lists the fields that can be added to the access log
+// entry, in the order they are added when log_fields has no argument.
+var availableLogFields = []string{
+	logFieldOutcome,
+	logFieldKey,
+	logFieldStorer,
+	logFieldBackendLatency,
+	logFieldStoredSize,
+}
+
+func isAvailableLogField(name string) bool {
+	for _, field := range availableLogFields {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logCacheFields exposes the cache result as request variables
+// (e.g. {http.vars.cache_outcome}) and adds it to the access log entry.
+func (s *SouinCaddyMiddleware) logCacheFields(r *http.Request, result cacheResult, state *requestState) {
+	if len(s.Configuration.DefaultCache.LogFields) == 0 {
+		return
+	}
+
+	extra, _ := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	set := func(name string, value any, field zap.Field) {
+		caddyhttp.SetVar(r.Context(), "cache_"+name, value)
+		if extra != nil {
+			extra.Set(field)
+		}
+	}
+
+	for _, name := range s.Configuration.DefaultCache.LogFields {
+		switch name {
+		case logFieldOutcome:
+			set(name, result.Outcome, zap.String("cache_outcome", result.Outcome))
+		case logFieldKey:
+			if result.Key != "" {
+				set(name, result.Key, zap.String("cache_key", result.Key))
+			}
+		case logFieldStorer:
+			if result.Storer != "" {
+				set(name, result.Storer, zap.String("cache_storer", result.Storer))
+			}
+		case logFieldBackendLatency:
+			if latency, called := state.upstream(); called {
+				set(name, latency, zap.Duration("cache_backend_latency", latency))
+			}
+		case logFieldStoredSize:
+			if size, stored := state.storedSize(); stored {
+				set(name, size, zap.Int64("cache_stored_size", size))
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/darkweak/souin/pkg/rfc"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	stateCached = "cached"
+	stateStale  = "stale"
+	stateMiss   = "miss"
+)
+
+func init() {
+	caddy.RegisterModule(CacheMatcher{})
+}
+
+// CacheMatcher matches the requests by the state of their response in the
+// cache, without fetching it from the upstream. The key and the storers are
+// the ones of a cache handler with the same configuration.
+//
+// The Caddyfile syntax is the states followed by the cache handler options:
+//
+//	@miss cache miss stale {
+//	    key {
+//	        headers Authorization
+//	    }
+//	}
+type CacheMatcher struct {
+	// Matched states, cached for a fresh response, stale for a stale one
+	// and miss when none is stored.
+	States []string `json:"states,omitempty"`
+	// Cache handler configuration the lookup is made with, completed by the
+	// global cache options.
+	Configuration Configuration `json:"configuration,omitempty"`
+
+	handler *SouinCaddyMiddleware
+}
+
+// CaddyModule returns the Caddy module information.
+func (CacheMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.cache",
+		New: func() caddy.Module { return new(CacheMatcher) },
+	}
+}
+
+// Provision provisions the cache handler the lookups are made with.
+func (m *CacheMatcher) Provision(ctx caddy.Context) error {
+	if len(m.States) == 0 {
+		return fmt.Errorf("the cache matcher requires at least one state")
+	}
+	for _, state := range m.States {
+		if state != stateCached && state != stateStale && state != stateMiss {
+			return fmt.Errorf("unsupported cache matcher state: %s", state)
+		}
+	}
+
+	m.handler = &SouinCaddyMiddleware{Configuration: m.Configuration, lookupOnly: true}
+
+	return m.handler.Provision(ctx)
+}
+
+// Cleanup stops the cache handler the lookups are made with.
+func (m *CacheMatcher) Cleanup() error {
+	if m.handler == nil {
+		return nil
+	}
+
+	return m.handler.Cleanup()
+}
+
+// Match returns whether the request response is in one of the states.
+func (m *CacheMatcher) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+
+	return match
+}
+
+// MatchWithError returns whether the request response is in one of the
+// states.
+func (m *CacheMatcher) MatchWithError(r *http.Request) (bool, error) {
+	return slices.Contains(m.States, m.handler.cacheState(r)), nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from the Caddyfile tokens, the
+// states are removed before the options are parsed as the cache handler
+// ones.
+func (m *CacheMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextArg() {
+			m.States = append(m.States, d.Val())
+			d.Delete()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+		}
+	}
+	if len(m.States) == 0 {
+		return d.ArgErr()
+	}
+	d.Reset()
+	m.Configuration = Configuration{
+		DefaultCache: DefaultCache{
+			AllowedHTTPVerbs: make([]string, 0),
+		},
+	}
+
+	return parseConfiguration(&m.Configuration, d, false)
+}
+
+// cacheState looks up the response the handler would serve to the request.
+func (s *SouinCaddyMiddleware) cacheState(r *http.Request) string {
+	if !s.isCachedMethod(r.Method) || (s.ExcludeRegex != nil && s.ExcludeRegex.MatchString(r.RequestURI)) {
+		return stateMiss
+	}
+	r, token := s.withTokens(r)
+	if token != "" {
+		return stateMiss
+	}
+	if requestCc, err := cacheobject.ParseRequestCacheControl(r.Header.Get("Cache-Control")); err != nil || requestCc.NoCache {
+		return stateMiss
+	}
+	if slice := int64(s.Configuration.DefaultCache.Slice); slice > 0 {
+		// The response is cached when its first slice is.
+		r = r.Clone(r.Context())
+		r.Header.Set(sliceHeader, fmt.Sprintf("bytes=0-%d", slice-1))
+	}
+
+	// The lookup is recorded in states of their own, the states of the
+	// request served by an enclosing cache handler are kept.
+	r, _ = withRequestState(r)
+	ctx, _ := withServedEntry(r.Context(), false)
+	r = r.WithContext(ctx)
+	kr := s.keyRequest(r)
+	rq := s.keyContext.SetContext(kr, kr)
+	_, storageKey := storageKeyFromContext(rq)
+	fresh, stale, _ := s.storedResponses(rq, storageKey)
+	switch {
+	case fresh != nil:
+		return stateCached
+	case stale != nil:
+		return stateStale
+	}
+
+	return stateMiss
+}
+
+// storedResponses looks up the fresh and the stale responses stored under
+// the storage key, without the instrumentation of the lookups made for the
+// requests served by the handler. The stale one is returned only within its
+// stale duration.
+func (s *SouinCaddyMiddleware) storedResponses(rq *http.Request, storageKey string) (fresh *http.Response, stale *http.Response, storerName string) {
+	for _, storer := range s.SouinBaseHandler.Storers {
+		if instrumented, ok := storer.(*instrumentedStorer); ok {
+			storer = instrumented.Storer
+		}
+		f, st := storer.GetMultiLevel(storageKey, rq, rfc.ParseRequest(rq))
+		if f != nil {
+			return f, nil, storer.Name()
+		}
+		if stale == nil && st != nil && withinStale(st) {
+			stale, storerName = st, storer.Name()
+		}
+	}
+
+	return nil, stale, storerName
+}
+
+// Interface guards
+var (
+	_ caddy.CleanerUpper                = (*CacheMatcher)(nil)
+	_ caddy.Provisioner                 = (*CacheMatcher)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*CacheMatcher)(nil)
+	_ caddyfile.Unmarshaler             = (*CacheMatcher)(nil)
+)
@@ -0,0 +1,191 @@
+package httpcache
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheMetrics = struct {
+	once           sync.Once
+	requests       *prometheus.CounterVec
+	storageLatency *prometheus.HistogramVec
+	storedBytes    *prometheus.CounterVec
+	coalesced      *prometheus.CounterVec
+	waiters        *prometheus.GaugeVec
+	timeouts       *prometheus.CounterVec
+	locks          *prometheus.CounterVec
+	purges         *prometheus.CounterVec
+	refreshAhead   *prometheus.CounterVec
+}{}
+
+func initCacheMetrics(registry *prometheus.Registry) error {
+	const ns, sub = "caddy", "cache"
+
+	cacheMetrics.once.Do(func() {
+		cacheMetrics.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "requests_total",
+			Help:      "Counter of requests handled by the cache, by outcome (hit, miss, stale, bypass).",
+		}, []string{"server", "handler", "host", "storer", "outcome"})
+		cacheMetrics.storageLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Histogram of the storers operations durations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"server", "handler", "storer", "operation"})
+		cacheMetrics.storedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "stored_bytes_total",
+			Help:      "Counter of response body bytes stored in the cache.",
+		}, []string{"server", "handler", "host", "storer"})
+		cacheMetrics.coalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "coalesced_requests_total",
+			Help:      "Counter of requests that reused the upstream response of a concurrent request.",
+		}, []string{"server", "handler", "host"})
+		cacheMetrics.waiters = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "coalescing_waiters",
+			Help:      "Gauge of requests waiting for the upstream response of a concurrent request.",
+		}, []string{"server", "handler", "host"})
+		cacheMetrics.timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "coalescing_timeouts_total",
+			Help:      "Counter of requests forwarded after waiting for the upstream response of a concurrent request for too long.",
+		}, []string{"server", "handler", "host"})
+		cacheMetrics.locks = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "coalescing_locks_total",
+			Help:      "Counter of the cluster coalescing locks, by result (acquired, waited, timeout, error).",
+		}, []string{"server", "handler", "host", "result"})
+		cacheMetrics.purges = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "purges_total",
+			Help:      "Counter of keys purged from the storers.",
+		}, []string{"server", "handler", "storer"})
+		cacheMetrics.refreshAhead = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "refresh_ahead_total",
+			Help:      "Counter of the refresh-ahead of the entries about to expire, by result (performed, skipped).",
+		}, []string{"server", "handler", "host", "result"})
+	})
+
+	// The collectors are shared between the cache handlers of every site, the
+	// duplicate registration of the same collector is expected and ignored.
+	for _, collector := range []prometheus.Collector{
+		cacheMetrics.requests,
+		cacheMetrics.storageLatency,
+		cacheMetrics.storedBytes,
+		cacheMetrics.coalesced,
+		cacheMetrics.waiters,
+		cacheMetrics.timeouts,
+		cacheMetrics.locks,
+		cacheMetrics.purges,
+		cacheMetrics.refreshAhead,
+	} {
+		if err := registry.Register(collector); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// serverNameFromRequest returns the name of the Caddy server handling the request.
+func serverNameFromRequest(r *http.Request) string {
+	if srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok && srv != nil {
+		return srv.Name()
+	}
+
+	return ""
+}
+
+// observeMetrics updates the cache metrics with the request result.
+func (s *SouinCaddyMiddleware) observeMetrics(r *http.Request, result cacheResult, state *requestState) {
+	if cacheMetrics.requests == nil {
+		return
+	}
+
+	server := s.serverName(r)
+	cacheMetrics.requests.WithLabelValues(server, s.route, r.Host, result.Storer, result.Outcome).Inc()
+
+	for storer, size := range state.storedSizes() {
+		cacheMetrics.storedBytes.WithLabelValues(server, s.route, r.Host, storer).Add(float64(size))
+	}
+
+	if _, called := state.upstream(); !called && result.Outcome == outcomeMiss && !s.Configuration.DefaultCache.DisableCoalescing {
+		cacheMetrics.coalesced.WithLabelValues(server, s.route, r.Host).Inc()
+	}
+}
+
+// observeCoalescingWaiter updates the count of requests waiting for the
+// upstream response of a concurrent request.
+func (s *SouinCaddyMiddleware) observeCoalescingWaiter(r *http.Request, delta float64) {
+	if cacheMetrics.waiters == nil {
+		return
+	}
+
+	cacheMetrics.waiters.WithLabelValues(s.serverName(r), s.route, r.Host).Add(delta)
+}
+
+// observeCoalescingTimeout counts a request that stopped waiting for the
+// upstream response of a concurrent request.
+func (s *SouinCaddyMiddleware) observeCoalescingTimeout(r *http.Request) {
+	if cacheMetrics.timeouts == nil {
+		return
+	}
+
+	cacheMetrics.timeouts.WithLabelValues(s.serverName(r), s.route, r.Host).Inc()
+}
+
+// observeCoalescingLock counts a cluster lock acquired, waited for until the
+// entry is stored, timed out or failed.
+func (s *SouinCaddyMiddleware) observeCoalescingLock(r *http.Request, result string) {
+	if cacheMetrics.locks == nil {
+		return
+	}
+
+	cacheMetrics.locks.WithLabelValues(s.serverName(r), s.route, r.Host, result).Inc()
+}
+
+// observeRefreshAhead counts a refresh-ahead performed or skipped.
+func (s *SouinCaddyMiddleware) observeRefreshAhead(r *http.Request, result string) {
+	if cacheMetrics.refreshAhead == nil {
+		return
+	}
+
+	cacheMetrics.refreshAhead.WithLabelValues(s.serverName(r), s.route, r.Host, result).Inc()
+}
+
+// serverName returns the name of the server the handler is running in.
+// A handler instance belongs to only one server, the name is kept to label
+// the storage operations that are not tied to a request.
+func (s *SouinCaddyMiddleware) serverName(r *http.Request) string {
+	if name, ok := s.server.Load().(string); ok {
+		return name
+	}
+	if r == nil {
+		return ""
+	}
+
+	name := serverNameFromRequest(r)
+	s.server.Store(name)
+
+	return name
+}
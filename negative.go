@@ -0,0 +1,129 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkweak/souin/pkg/rfc"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// negativeTTLField is the targeted field recorded when the negative_ttl
+// lifetime replaced the Cache-Control header.
+const negativeTTLField = "negative_ttl"
+
+// isNegativeStatus returns whether the status is a code (e.g. 404) or a
+// class (e.g. 5xx) of error or redirect responses.
+func isNegativeStatus(status string) bool {
+	if len(status) != 3 || status[0] < '3' || status[0] > '5' {
+		return false
+	}
+	if status[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(status)
+
+	return err == nil
+}
+
+// allowedStatusCodes returns the additional status codes completed with the
+// ones covered by the negative_ttl statuses.
+func (n *NegativeTTL) allowedStatusCodes(codes []int) []int {
+	codes = slices.Clone(codes)
+	for code := 300; code < 600; code++ {
+		if _, ok := n.lifetime(code); ok && !slices.Contains(codes, code) {
+			codes = append(codes, code)
+		}
+	}
+
+	return codes
+}
+
+// lifetime returns the lifetime of the status code, the code takes
+// precedence over its class.
+func (n *NegativeTTL) lifetime(code int) (time.Duration, bool) {
+	if ttl, ok := n.Statuses[strconv.Itoa(code)]; ok {
+		return ttl.Duration, true
+	}
+	if ttl, ok := n.Statuses[fmt.Sprintf("%dxx", code/100)]; ok {
+		return ttl.Duration, true
+	}
+
+	return 0, false
+}
+
+// applyNegativeTTL replaces the lifetime of the upstream error and redirect
+// responses with the negative_ttl one. When preserve_positive is enabled,
+// the negative response is not stored over a fresh successful one.
+func (s *SouinCaddyMiddleware) applyNegativeTTL(rq *http.Request, header http.Header, code int) {
+	cfg := s.Configuration.DefaultCache.NegativeTTL
+	if cfg == nil {
+		return
+	}
+	ttl, ok := cfg.lifetime(code)
+	if !ok {
+		return
+	}
+	responseCc, err := cacheobject.ParseResponseCacheControl(rfc.HeaderAllCommaSepValuesString(header, "Cache-Control"))
+	if err == nil && (responseCc.NoStore || responseCc.PrivatePresent) {
+		return
+	}
+
+	value := fmt.Sprintf("max-age=%d", int64(ttl.Seconds()))
+	if ttl <= 0 || (cfg.PreservePositive && s.hasFreshPositive(rq, header)) {
+		value = "no-store"
+	}
+	s.overrideCacheControl(header, negativeTTLField, value)
+}
+
+// hasFreshPositive returns whether the storers hold a fresh successful
+// response in the variant the negative response would be stored in.
+func (s *SouinCaddyMiddleware) hasFreshPositive(rq *http.Request, header http.Header) bool {
+	_, storageKey := storageKeyFromContext(rq)
+	if storageKey == "" {
+		return false
+	}
+	varied, star := rfc.VariedHeaderAllCommaSepValues(header)
+	if star {
+		return false
+	}
+
+	for _, storer := range s.SouinBaseHandler.Storers {
+		// The lookup must not be recorded as the one of the request.
+		if instrumented, ok := storer.(*instrumentedStorer); ok {
+			storer = instrumented.Storer
+		}
+		fresh, _ := storer.GetMultiLevel(storageKey, rq, rfc.ParseRequest(rq))
+		if fresh == nil {
+			continue
+		}
+		_ = fresh.Body.Close()
+		if fresh.StatusCode >= http.StatusOK && fresh.StatusCode < http.StatusMultipleChoices && sameVariant(fresh.Header, varied) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameVariant returns whether the stored response matching the request
+// varies on the same headers as the negative response, both are then
+// stored under the same variant key.
+func sameVariant(stored http.Header, varied []string) bool {
+	storedVaried, _ := rfc.VariedHeaderAllCommaSepValues(stored)
+	normalize := func(names []string) []string {
+		normalized := make([]string, 0, len(names))
+		for _, name := range names {
+			normalized = append(normalized, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+		slices.Sort(normalized)
+
+		return slices.Compact(normalized)
+	}
+
+	return slices.Equal(normalize(storedVaried), normalize(varied))
+}
@@ -0,0 +1,128 @@
+package httpcache
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// keyNormalizer is a compiled cache_keys normalization.
+type keyNormalizer struct {
+	pattern   *regexp.Regexp
+	normalize *KeyNormalize
+}
+
+func newKeyNormalizers(overrides []CacheKeyNormalize) ([]keyNormalizer, error) {
+	normalizers := make([]keyNormalizer, 0, len(overrides))
+	for i := range overrides {
+		pattern, err := regexp.Compile(overrides[i].Pattern)
+		if err != nil {
+			return nil, err
+		}
+		normalizers = append(normalizers, keyNormalizer{pattern: pattern, normalize: &overrides[i].Normalize})
+	}
+
+	return normalizers, nil
+}
+
+// keyNormalize returns the normalization of the first cache_keys pattern
+// matching the request URI, the key one otherwise.
+func (s *SouinCaddyMiddleware) keyNormalize(requestURI string) *KeyNormalize {
+	for _, n := range s.keyNormalizers {
+		if n.pattern.MatchString(requestURI) {
+			return n.normalize
+		}
+	}
+
+	return s.Configuration.DefaultCache.KeyNormalize
+}
+
+// apply normalizes the request host, path and raw query.
+func (n *KeyNormalize) apply(host, path, rawQuery string) (string, string, string) {
+	if n.LowercaseHost {
+		host = strings.ToLower(host)
+	}
+	if n.StripTrailingSlash && len(path) > 1 {
+		if path = strings.TrimRight(path, "/"); path == "" {
+			path = "/"
+		}
+	}
+	if rawQuery == "" || !(n.SortQuery || n.DecodeUnreserved || n.DropEmptyParams) {
+		return host, path, rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if _, value, found := strings.Cut(param, "="); n.DropEmptyParams && (param == "" || found && value == "") {
+			continue
+		}
+		if n.DecodeUnreserved {
+			param = decodeUnreserved(param)
+		}
+		kept = append(kept, param)
+	}
+	if n.SortQuery {
+		sort.SliceStable(kept, func(i, j int) bool {
+			return paramName(kept[i]) < paramName(kept[j])
+		})
+	}
+
+	return host, path, strings.Join(kept, "&")
+}
+
+func paramName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		return unescaped
+	}
+
+	return name
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+
+	return 0, false
+}
+
+// decodeUnreserved decodes the percent-encoded unreserved characters and
+// uppercases the hexadecimal digits of the other ones (RFC 3986 section 6.2.2).
+func decodeUnreserved(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			hi, ok1 := unhex(s[i+1])
+			lo, ok2 := unhex(s[i+2])
+			if ok1 && ok2 {
+				if c := hi<<4 | lo; isUnreserved(c) {
+					b.WriteByte(c)
+				} else {
+					b.WriteString(strings.ToUpper(s[i : i+3]))
+				}
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
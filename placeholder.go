@@ -0,0 +1,130 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	// staleHeader keeps the stale duration evaluated for the stored
+	// response, it is removed before the response is sent.
+	staleHeader = "Cache-Handler-Stale"
+	// ttlField is the targeted field recorded when the evaluated ttl
+	// completed the Cache-Control header.
+	ttlField = "ttl"
+)
+
+// hasPlaceholder returns whether the configuration value contains Caddy
+// placeholders.
+func hasPlaceholder(value string) bool {
+	open := strings.Index(value, "{")
+
+	return open >= 0 && strings.Contains(value[open:], "}")
+}
+
+// replacePlaceholders evaluates the placeholders of the value for the request.
+func replacePlaceholders(r *http.Request, value string) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+
+	return strings.TrimSpace(repl.ReplaceAll(value, ""))
+}
+
+// placeholderDuration evaluates the placeholders of the value and parses
+// the duration, a number is a count of seconds.
+func placeholderDuration(r *http.Request, value string) (time.Duration, bool) {
+	v := replacePlaceholders(r, value)
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, seconds >= 0
+	}
+	d, err := time.ParseDuration(v)
+
+	return d, err == nil && d >= 0
+}
+
+// upstreamHeaderPrefix is the prefix of the placeholders reverse_proxy gives
+// to the upstream response header fields in its handle_response routes.
+const upstreamHeaderPrefix = "http.reverse_proxy.header."
+
+// setUpstreamPlaceholders exposes the upstream response header fields as the
+// {http.reverse_proxy.header.*} placeholders.
+func setUpstreamPlaceholders(r *http.Request, header http.Header) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Map(func(key string) (any, bool) {
+		field, found := strings.CutPrefix(key, upstreamHeaderPrefix)
+		if !found {
+			return nil, false
+		}
+
+		return strings.Join(header.Values(field), ","), true
+	})
+}
+
+// applyPlaceholders applies the default_cache_control and the ttl evaluated
+// for the request to the upstream response, and records its stale duration.
+func (s *SouinCaddyMiddleware) applyPlaceholders(r *http.Request, header http.Header) {
+	dc := s.Configuration.DefaultCache
+	if dc.DefaultCacheControlPlaceholder == "" && dc.TTLPlaceholder == "" && dc.StalePlaceholder == "" {
+		return
+	}
+	setUpstreamPlaceholders(r, header)
+	name, value := s.SurrogateKeyStorer.GetSurrogateControl(header)
+	if dc.DefaultCacheControlPlaceholder != "" && value == "" {
+		value = replacePlaceholders(r, dc.DefaultCacheControlPlaceholder)
+		if _, err := cacheobject.ParseResponseCacheControl(value); value == "" || err != nil {
+			value = dc.DefaultCacheControl
+		}
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	// The freshness set by the upstream or default_cache_control takes
+	// precedence, as it does over the static ttl.
+	if dc.TTLPlaceholder != "" && name == "Cache-Control" {
+		responseCc, err := cacheobject.ParseResponseCacheControl(value)
+		if err == nil && responseCc.MaxAge < 0 && responseCc.SMaxAge < 0 && header.Get("Expires") == "" {
+			ttl, ok := placeholderDuration(r, dc.TTLPlaceholder)
+			if !ok || ttl <= 0 {
+				ttl = dc.TTL.Duration
+			}
+			directives := fmt.Sprintf("s-maxage=%d", int64(ttl.Seconds()))
+			if value != "" {
+				directives = value + ", " + directives
+			}
+			s.overrideCacheControl(header, ttlField, directives)
+		}
+	}
+
+	if dc.StalePlaceholder != "" {
+		stale, ok := placeholderDuration(r, dc.StalePlaceholder)
+		if !ok || stale > dc.Stale.Duration {
+			// The storers keep the responses for the stale fallback.
+			stale = dc.Stale.Duration
+		}
+		header.Set(staleHeader, stale.String())
+	}
+}
+
+// withinStale returns whether the stale response is still within the stale
+// duration evaluated when it has been stored.
+func withinStale(res *http.Response) bool {
+	stale, err := time.ParseDuration(res.Header.Get(staleHeader))
+	if err != nil {
+		return true
+	}
+	expires, _, ok := storedExpiry(res)
+
+	return !ok || time.Since(expires) <= stale
+}
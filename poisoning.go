@@ -0,0 +1,172 @@
+package httpcache
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	poisoningStrip  = "strip"
+	poisoningKey    = "key"
+	poisoningDetect = "detect"
+
+	// poisoningWindow is how long the response of a key is compared with
+	// the next ones.
+	poisoningWindow = 10 * time.Minute
+	poisoningSweep  = 1024
+)
+
+// defaultUnkeyedHeaders are the request headers known to change the
+// upstream response without being part of the key.
+var defaultUnkeyedHeaders = []string{
+	"X-Forwarded-Host",
+	"X-Forwarded-Scheme",
+	"X-Forwarded-Server",
+	"X-Host",
+	"X-Original-URL",
+	"X-Rewrite-URL",
+	"X-HTTP-Method-Override",
+}
+
+// unkeyedHeaders returns the protected request headers.
+func (p *PoisoningProtection) unkeyedHeaders() []string {
+	if len(p.Headers) == 0 {
+		return defaultUnkeyedHeaders
+	}
+
+	return p.Headers
+}
+
+// stripUnkeyedHeaders removes the unkeyed headers from the request
+// forwarded to the upstream for a cacheable request.
+func (s *SouinCaddyMiddleware) stripUnkeyedHeaders(r *http.Request) *http.Request {
+	p := s.Configuration.DefaultCache.PoisoningProtection
+	if p == nil || p.Mode != poisoningStrip || !s.isCachedMethod(r.Method) {
+		return r
+	}
+
+	var rq *http.Request
+	for _, name := range p.unkeyedHeaders() {
+		if _, ok := r.Header[http.CanonicalHeaderKey(name)]; !ok {
+			continue
+		}
+		if rq == nil {
+			rq = r.Clone(r.Context())
+		}
+		rq.Header.Del(name)
+	}
+	if rq == nil {
+		return r
+	}
+
+	return rq
+}
+
+// unkeyedSignature returns the values of the unkeyed headers of the
+// request.
+func (p *PoisoningProtection) unkeyedSignature(r *http.Request) string {
+	values := make([]string, 0)
+	for _, name := range p.unkeyedHeaders() {
+		values = append(values, name+"="+strings.Join(r.Header.Values(name), ","))
+	}
+
+	return strings.Join(values, "; ")
+}
+
+// poisoningEntry is the last upstream response of a key.
+type poisoningEntry struct {
+	signature string
+	status    int
+	digest    uint64
+	expires   time.Time
+}
+
+// poisoningDetector compares the upstream responses of the requests with
+// the same key but different unkeyed headers.
+type poisoningDetector struct {
+	mu        sync.Mutex
+	entries   map[string]*poisoningEntry
+	nextSweep int
+}
+
+func newPoisoningDetector() *poisoningDetector {
+	return &poisoningDetector{
+		entries:   map[string]*poisoningEntry{},
+		nextSweep: poisoningSweep,
+	}
+}
+
+// observe records the upstream response of the key and returns whether it
+// differs from the previous one, fetched with other unkeyed headers.
+func (d *poisoningDetector) observe(key string, entry *poisoningEntry) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	previous, ok := d.entries[key]
+	entry.expires = now.Add(poisoningWindow)
+	d.entries[key] = entry
+
+	if len(d.entries) >= d.nextSweep {
+		for k, e := range d.entries {
+			if e.expires.Before(now) {
+				delete(d.entries, k)
+			}
+		}
+		d.nextSweep = max(2*len(d.entries), poisoningSweep)
+	}
+
+	return ok && previous.expires.After(now) && previous.signature != entry.signature &&
+		(previous.status != entry.status || previous.digest != entry.digest)
+}
+
+// digestResponseWriter computes the digest of the upstream response.
+type digestResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	status int
+	digest *xxhash.Digest
+}
+
+func (w *digestResponseWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriterWrapper.WriteHeader(code)
+}
+
+func (w *digestResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	_, _ = w.digest.Write(b)
+
+	return w.ResponseWriterWrapper.Write(b)
+}
+
+// detectPoisoning wraps the upstream response writer to compare the
+// response with the previous one of the key, the returned function logs
+// the difference once the response has been written.
+func (s *SouinCaddyMiddleware) detectPoisoning(rw http.ResponseWriter, r *http.Request, key string) (http.ResponseWriter, func()) {
+	p := s.Configuration.DefaultCache.PoisoningProtection
+	if p == nil || p.Mode != poisoningDetect || s.poisoning == nil || key == "" {
+		return rw, func() {}
+	}
+
+	w := &digestResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rw},
+		digest:                xxhash.New(),
+	}
+
+	return w, func() {
+		signature := p.unkeyedSignature(r)
+		entry := &poisoningEntry{signature: signature, status: w.status, digest: w.digest.Sum64()}
+		if s.poisoning.observe(key, entry) {
+			s.logger.Warnf("Possible cache poisoning of %s, the response differs for requests only differing in the unkeyed headers: %s", key, signature)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package httpcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	// privateHeader carries the hash of the user identity, it is part of
+	// the key when the private cache is enabled.
+	privateHeader = "Cache-Handler-Private"
+	// privateField is the targeted field recorded when the private
+	// directive has been removed from the stored Cache-Control header.
+	privateField = "private"
+	// privateTagPrefix prefixes the surrogate key the responses of a user
+	// are tagged with, to be purged together.
+	privateTagPrefix = "private-"
+	surrogateKey     = "Surrogate-Key"
+)
+
+// identityHash returns the hash of the user identity used in the key and in
+// the surrogate key of the user responses.
+func identityHash(identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// privateTag returns the surrogate key of the responses of the user.
+func privateTag(hash string) string {
+	return privateTagPrefix + hash
+}
+
+// identity returns the user identity of the request, the first source that
+// is set in the header, cookie and placeholder order.
+func (p *PrivateCache) identity(r *http.Request) string {
+	if p.Header == "" && p.Cookie == "" && p.Placeholder == "" {
+		return r.Header.Get("Authorization")
+	}
+	if p.Header != "" {
+		if value := r.Header.Get(p.Header); value != "" {
+			return value
+		}
+	}
+	if p.Cookie != "" {
+		if c, err := r.Cookie(p.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if p.Placeholder != "" {
+		return replacePlaceholders(r, p.Placeholder)
+	}
+
+	return ""
+}
+
+// privateKeyHeaders returns the key request headers scoping the key to the
+// user identity. The Authorization header of the identified requests is
+// removed for the Souin base handler to store their responses. The identity
+// hash is kept in the header of the key request, the response is only made
+// shareable for the user the key was scoped to.
+func (s *SouinCaddyMiddleware) privateKeyHeaders(r *http.Request, headers map[string]string) map[string]string {
+	p := s.Configuration.DefaultCache.Private
+	if p == nil {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	// The header sent by the client is never trusted.
+	headers[privateHeader] = ""
+	if identity := p.identity(r); identity != "" {
+		headers[privateHeader] = identityHash(identity)
+		headers["Authorization"] = ""
+	}
+
+	return headers
+}
+
+// privateHash returns the identity hash the key of the request was scoped
+// to, empty when the key is shared. r is the key request, or the request
+// given by the Souin base handler.
+func (s *SouinCaddyMiddleware) privateHash(r *http.Request) string {
+	if s.Configuration.DefaultCache.Private == nil {
+		return ""
+	}
+
+	return r.Header.Get(privateHeader)
+}
+
+// applyPrivate removes the private directive from the Cache-Control header
+// of the responses to the identified requests and tags them with the user
+// surrogate key. The identity is the one the key was built with, it may be
+// set by the next handlers only after the key is built, e.g. by an
+// authentication handler, and the response is then kept private.
+func (s *SouinCaddyMiddleware) applyPrivate(r *http.Request, header http.Header) {
+	hash := s.privateHash(r)
+	if hash == "" {
+		return
+	}
+
+	if !s.Configuration.SurrogateKeyDisabled {
+		tag := privateTag(hash)
+		if keys := header.Get(surrogateKey); keys != "" {
+			tag = keys + ", " + tag
+		}
+		header.Set(surrogateKey, tag)
+	}
+
+	name, value := s.SurrogateKeyStorer.GetSurrogateControl(header)
+	if name != "Cache-Control" {
+		return
+	}
+	responseCc, err := cacheobject.ParseResponseCacheControl(value)
+	if err != nil || !responseCc.PrivatePresent {
+		return
+	}
+	directives := make([]string, 0)
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		d, _, _ := strings.Cut(directive, "=")
+		if directive != "" && !strings.EqualFold(d, privateField) {
+			directives = append(directives, directive)
+		}
+	}
+	s.overrideCacheControl(header, privateField, strings.Join(directives, ", "))
+}
+
+// restorePrivate removes the user surrogate key from the response sent to
+// the client.
+func (s *SouinCaddyMiddleware) restorePrivate(r *http.Request, header http.Header) {
+	keys := header.Get(surrogateKey)
+	hash := s.privateHash(r)
+	if keys == "" || hash == "" {
+		return
+	}
+
+	tag := privateTag(hash)
+	kept := make([]string, 0)
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key != "" && key != tag {
+			kept = append(kept, key)
+		}
+	}
+	if len(kept) == 0 {
+		header.Del(surrogateKey)
+		return
+	}
+	header.Set(surrogateKey, strings.Join(kept, ", "))
+}
@@ -0,0 +1,557 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkweak/souin/configurationtypes"
+	"github.com/darkweak/storages/core"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	purgeBusRedis  = "redis"
+	purgeBusNATS   = "nats"
+	purgeBusMemory = "memory"
+
+	defaultPurgeBusChannel = "caddy-cache-purge"
+	// purgeEventIDHeader carries the ID of the purge event sent to the admin
+	// API, the retried purges are then applied once by the other nodes.
+	purgeEventIDHeader = "Cache-Purge-Event-Id"
+	// souinPurgeEndpoint is the Souin API endpoint the purge events are
+	// applied with, whatever the API configuration of the node.
+	souinPurgeEndpoint = "/souin-api/souin"
+
+	purgeEventAPI     = "api"
+	purgeEventPrivate = "private"
+
+	// purgeEventsWindow is how long the IDs of the applied events are
+	// remembered.
+	purgeEventsWindow = 10 * time.Minute
+	purgeEventsSweep  = 1024
+	purgeBusRetry     = time.Second
+	natsTimeout       = 5 * time.Second
+)
+
+// purgeHeaders are the request headers carrying the surrogate keys of the
+// Souin API purges.
+var purgeHeaders = []string{"Cache-Groups", "Surrogate-Key", "Edge-Cache-Tag", "Cache-Tags", "Cache-Tag"}
+
+var errPurgeBusClosed = errors.New("the purge bus is closed")
+
+// purgeEvent is a purge made through the admin API of a node.
+type purgeEvent struct {
+	ID   string    `json:"id"`
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Request sent to the Souin API endpoint, the URI is relative to the
+	// endpoint.
+	Method string      `json:"method,omitempty"`
+	URI    string      `json:"uri,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	// Identity hash of the user whose private responses are purged.
+	Hash string `json:"hash,omitempty"`
+}
+
+// purgeTransport carries the purge events between the nodes.
+type purgeTransport interface {
+	publish(payload []byte) error
+	// listen delivers the published payloads until the subscription fails
+	// or the transport is closed.
+	listen(deliver func([]byte)) error
+	close() error
+}
+
+// purgePeer is the last event applied from a node.
+type purgePeer struct {
+	LastEventID   string    `json:"last_event_id"`
+	LastEventTime time.Time `json:"last_event_time"`
+	AppliedAt     time.Time `json:"applied_at"`
+	Applied       uint64    `json:"applied"`
+	Failed        uint64    `json:"failed"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// purgeBusStatus is the status of the purge bus reported by the admin API.
+type purgeBusStatus struct {
+	Node       string               `json:"node"`
+	Backend    string               `json:"backend"`
+	Channel    string               `json:"channel"`
+	Published  uint64               `json:"published"`
+	Duplicates uint64               `json:"duplicates"`
+	Peers      map[string]purgePeer `json:"peers"`
+}
+
+// purgeBus broadcasts the purges of the node and applies the ones of the
+// other nodes, once per event ID.
+type purgeBus struct {
+	node      string
+	backend   string
+	channel   string
+	transport purgeTransport
+	apply     func(*purgeEvent) error
+	logger    core.Logger
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu         sync.Mutex
+	seen       map[string]time.Time
+	nextSweep  int
+	published  uint64
+	duplicates uint64
+	peers      map[string]*purgePeer
+}
+
+func newPurgeBus(cfg *PurgeBus, apply func(*purgeEvent) error, logger core.Logger) (*purgeBus, error) {
+	b := &purgeBus{
+		node:      cfg.Node,
+		backend:   cfg.Backend,
+		channel:   cfg.Channel,
+		apply:     apply,
+		logger:    logger,
+		done:      make(chan struct{}),
+		seen:      map[string]time.Time{},
+		nextSweep: purgeEventsSweep,
+		peers:     map[string]*purgePeer{},
+	}
+	if b.channel == "" {
+		b.channel = defaultPurgeBusChannel
+	}
+	if b.node == "" {
+		if hostname, err := os.Hostname(); err == nil && hostname != "" {
+			b.node = hostname
+		} else {
+			b.node = rand.Text()
+		}
+	}
+
+	switch cfg.Backend {
+	case purgeBusRedis:
+		client, err := newRedisClient(cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		b.transport = &redisTransport{client: client, channel: b.channel}
+	case purgeBusNATS:
+		transport, err := newNATSTransport(cfg.Address, b.channel)
+		if err != nil {
+			return nil, err
+		}
+		b.transport = transport
+	case purgeBusMemory:
+		b.transport = newMemoryTransport(b.channel)
+	default:
+		return nil, fmt.Errorf("unsupported purge bus backend: %s", cfg.Backend)
+	}
+	go b.run()
+
+	return b, nil
+}
+
+// run subscribes to the channel until the bus is closed.
+func (b *purgeBus) run() {
+	for {
+		err := b.transport.listen(b.receive)
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		b.logger.Warnf("Purge bus %s subscription interrupted, retrying in %s: %v", b.backend, purgeBusRetry, err)
+		select {
+		case <-b.done:
+			return
+		case <-time.After(purgeBusRetry):
+		}
+	}
+}
+
+func (b *purgeBus) close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		_ = b.transport.close()
+	})
+}
+
+// remember records the event ID and returns false when it is already known.
+func (b *purgeBus) remember(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if expires, ok := b.seen[id]; ok && expires.After(now) {
+		return false
+	}
+	b.seen[id] = now.Add(purgeEventsWindow)
+	if len(b.seen) >= b.nextSweep {
+		for k, expires := range b.seen {
+			if expires.Before(now) {
+				delete(b.seen, k)
+			}
+		}
+		b.nextSweep = max(2*len(b.seen), purgeEventsSweep)
+	}
+
+	return true
+}
+
+// publish broadcasts the purge applied by the node.
+func (b *purgeBus) publish(e *purgeEvent) {
+	if e.ID == "" {
+		e.ID = rand.Text()
+	}
+	e.Node, e.Time = b.node, time.Now()
+	if !b.remember(e.ID) {
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err == nil {
+		err = b.transport.publish(payload)
+	}
+	if err != nil {
+		b.logger.Errorf("Unable to publish the purge event %s on the %s purge bus: %v", e.ID, b.backend, err)
+		return
+	}
+
+	b.mu.Lock()
+	b.published++
+	b.mu.Unlock()
+}
+
+// receive applies the purge of another node.
+func (b *purgeBus) receive(payload []byte) {
+	var e purgeEvent
+	if err := json.Unmarshal(payload, &e); err != nil || e.ID == "" {
+		b.logger.Warnf("Invalid purge event received on the %s purge bus: %s", b.backend, payload)
+		return
+	}
+	if e.Node == b.node {
+		return
+	}
+	if !b.remember(e.ID) {
+		b.mu.Lock()
+		b.duplicates++
+		b.mu.Unlock()
+		return
+	}
+
+	err := b.apply(&e)
+	if err != nil {
+		b.logger.Errorf("Unable to apply the purge event %s of %s: %v", e.ID, e.Node, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	peer, ok := b.peers[e.Node]
+	if !ok {
+		peer = &purgePeer{}
+		b.peers[e.Node] = peer
+	}
+	peer.LastEventID, peer.LastEventTime, peer.AppliedAt = e.ID, e.Time, time.Now()
+	peer.Applied++
+	peer.LastError = ""
+	if err != nil {
+		peer.Failed++
+		peer.LastError = err.Error()
+	}
+}
+
+func (b *purgeBus) status() purgeBusStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peers := make(map[string]purgePeer, len(b.peers))
+	for node, peer := range b.peers {
+		peers[node] = *peer
+	}
+
+	return purgeBusStatus{
+		Node:       b.node,
+		Backend:    b.backend,
+		Channel:    b.channel,
+		Published:  b.published,
+		Duplicates: b.duplicates,
+		Peers:      peers,
+	}
+}
+
+// apiPurgeEvent returns the event of the purge or invalidation request sent
+// to the Souin API endpoint, nil for the other requests.
+func (s *SouinApp) apiPurgeEvent(r *http.Request, endpoint string) (*purgeEvent, error) {
+	if s.bus == nil || (r.Method != "PURGE" && r.Method != http.MethodPost) || endpoint != souinEndpoint(s.API) {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	e := &purgeEvent{
+		ID:     r.Header.Get(purgeEventIDHeader),
+		Kind:   purgeEventAPI,
+		Method: r.Method,
+		URI:    r.RequestURI[strings.Index(r.RequestURI, endpoint)+len(endpoint):],
+		Body:   body,
+	}
+	for _, name := range purgeHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			if e.Header == nil {
+				e.Header = http.Header{}
+			}
+			e.Header[name] = values
+		}
+	}
+
+	return e, nil
+}
+
+// souinEndpoint returns the path of the Souin API endpoint.
+func souinEndpoint(cfg configurationtypes.API) string {
+	base, souin := cfg.BasePath, cfg.Souin.BasePath
+	if base == "" {
+		base = "/souin-api"
+	}
+	if souin == "" {
+		souin = "/souin"
+	}
+
+	return base + souin
+}
+
+// publishPurge broadcasts the purge when the purge bus is enabled.
+func (s *SouinApp) publishPurge(e *purgeEvent) {
+	if s.bus != nil && e != nil {
+		s.bus.publish(e)
+	}
+}
+
+// applyPurge applies the purge event of another node to the storers.
+func (s *SouinApp) applyPurge(e *purgeEvent) error {
+	if s.SurrogateStorage == nil {
+		return errors.New("the surrogate keys are disabled")
+	}
+
+	switch e.Kind {
+	case purgeEventPrivate:
+		if e.Hash == "" {
+			return errors.New("the private purge event has no hash")
+		}
+		s.purgePrivate(e.Hash)
+	case purgeEventAPI:
+		r, err := http.NewRequest(e.Method, souinPurgeEndpoint+e.URI, bytes.NewReader(e.Body))
+		if err != nil {
+			return err
+		}
+		r.RequestURI = souinPurgeEndpoint + e.URI
+		for name, values := range e.Header {
+			r.Header[name] = values
+		}
+		w := newCacheResponseWriter(newDiscardResponseWriter())
+		s.purgeHandler(w, r)
+		if w.Status() >= http.StatusBadRequest {
+			return fmt.Errorf("the %s %s purge failed with the status %d", e.Method, e.URI, w.Status())
+		}
+	default:
+		return fmt.Errorf("unsupported purge event kind: %s", e.Kind)
+	}
+
+	return nil
+}
+
+// purgePrivate removes the private responses of the user with the identity
+// hash.
+func (s *SouinApp) purgePrivate(hash string) {
+	keys, _ := s.SurrogateStorage.Purge(http.Header{surrogateKey: []string{privateTag(hash)}})
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		for _, storer := range s.Storers {
+			purgeVariants(storer, key)
+		}
+	}
+}
+
+// memoryChannels are the in-process listeners by channel.
+var memoryChannels = struct {
+	sync.Mutex
+	listeners map[string]map[*memoryTransport]func([]byte)
+}{listeners: map[string]map[*memoryTransport]func([]byte){}}
+
+// memoryTransport delivers the events to the buses of the same process.
+type memoryTransport struct {
+	channel   string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemoryTransport(channel string) *memoryTransport {
+	return &memoryTransport{channel: channel, done: make(chan struct{})}
+}
+
+func (t *memoryTransport) publish(payload []byte) error {
+	memoryChannels.Lock()
+	listeners := make([]func([]byte), 0, len(memoryChannels.listeners[t.channel]))
+	for _, deliver := range memoryChannels.listeners[t.channel] {
+		listeners = append(listeners, deliver)
+	}
+	memoryChannels.Unlock()
+
+	for _, deliver := range listeners {
+		deliver(payload)
+	}
+
+	return nil
+}
+
+func (t *memoryTransport) listen(deliver func([]byte)) error {
+	memoryChannels.Lock()
+	if memoryChannels.listeners[t.channel] == nil {
+		memoryChannels.listeners[t.channel] = map[*memoryTransport]func([]byte){}
+	}
+	memoryChannels.listeners[t.channel][t] = deliver
+	memoryChannels.Unlock()
+
+	<-t.done
+
+	memoryChannels.Lock()
+	delete(memoryChannels.listeners[t.channel], t)
+	if len(memoryChannels.listeners[t.channel]) == 0 {
+		delete(memoryChannels.listeners, t.channel)
+	}
+	memoryChannels.Unlock()
+
+	return errPurgeBusClosed
+}
+
+func (t *memoryTransport) close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+
+	return nil
+}
+
+// redisTransport carries the events over the Redis pub/sub.
+type redisTransport struct {
+	client  *redis.Client
+	channel string
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+	closed bool
+}
+
+func (t *redisTransport) publish(payload []byte) error {
+	return t.client.Publish(context.Background(), t.channel, payload).Err()
+}
+
+func (t *redisTransport) listen(deliver func([]byte)) error {
+	ctx := context.Background()
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+
+		return errPurgeBusClosed
+	}
+	pubsub := t.client.Subscribe(ctx, t.channel)
+	t.pubsub = pubsub
+	t.mu.Unlock()
+	defer pubsub.Close()
+
+	for {
+		message, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		deliver([]byte(message.Payload))
+	}
+}
+
+func (t *redisTransport) close() error {
+	t.mu.Lock()
+	t.closed = true
+	if t.pubsub != nil {
+		_ = t.pubsub.Close()
+	}
+	t.mu.Unlock()
+
+	return t.client.Close()
+}
+
+// natsTransport carries the events over a NATS subject, the client
+// reconnects and subscribes again when the connection is lost.
+type natsTransport struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// newNATSTransport connects to the NATS server, either host:port or
+// nats://[user:password@|token@]host:port. The connection is retried in
+// background when the server is unavailable.
+func newNATSTransport(address, subject string) (*natsTransport, error) {
+	conn, err := nats.Connect(address,
+		nats.Name(moduleName),
+		nats.Timeout(natsTimeout),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nats address %s: %w", address, err)
+	}
+
+	return &natsTransport{conn: conn, subject: subject}, nil
+}
+
+func (t *natsTransport) publish(payload []byte) error {
+	return t.conn.Publish(t.subject, payload)
+}
+
+func (t *natsTransport) listen(deliver func([]byte)) error {
+	sub, err := t.conn.SubscribeSync(t.subject)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	for {
+		message, err := sub.NextMsgWithContext(context.Background())
+		if err != nil {
+			return err
+		}
+		deliver(message.Data)
+	}
+}
+
+func (t *natsTransport) close() error {
+	t.conn.Close()
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ purgeTransport = (*memoryTransport)(nil)
+	_ purgeTransport = (*redisTransport)(nil)
+	_ purgeTransport = (*natsTransport)(nil)
+)
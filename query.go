@@ -0,0 +1,343 @@
+package httpcache
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxNoVarySearchRules bounds the number of resources whose No-Vary-Search
+// rule is remembered, the rules are forgotten once it is reached.
+const maxNoVarySearchRules = 10000
+
+var errInvalidNoVarySearch = errors.New("invalid No-Vary-Search header")
+
+// queryRule describes the query parameters part of the cache key.
+type queryRule struct {
+	// Patterns of the parameters removed from the key.
+	ignore []string
+	// Patterns of the parameters kept in the key when restrict is set.
+	keep     []string
+	restrict bool
+	// Sort the parameters by name.
+	sort bool
+}
+
+func newQueryRule(q *KeyQuery) queryRule {
+	return queryRule{
+		ignore:   q.Ignore,
+		keep:     q.Only,
+		restrict: len(q.Only) > 0,
+		sort:     q.Sort,
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q queryRule) ignored(name string) bool {
+	return matchAny(q.ignore, name) || (q.restrict && !matchAny(q.keep, name))
+}
+
+// apply returns the raw query without the ignored parameters, sorted when
+// required. The kept parameters are not re-encoded.
+func (q queryRule) apply(rawQuery string) string {
+	type param struct {
+		name, raw string
+	}
+
+	params := make([]param, 0)
+	for _, raw := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(raw, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !q.ignored(name) {
+			params = append(params, param{name: name, raw: raw})
+		}
+	}
+	if q.sort {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].name < params[j].name
+		})
+	}
+
+	raws := make([]string, 0, len(params))
+	for _, p := range params {
+		raws = append(raws, p.raw)
+	}
+
+	return strings.Join(raws, "&")
+}
+
+// parseNoVarySearch parses the No-Vary-Search structured field dictionary,
+// e.g. key-order, params=("utm_source" "utm_medium") or params, except=("id").
+func parseNoVarySearch(value string) (queryRule, error) {
+	rule := queryRule{}
+	var params, except []string
+	paramsAll, hasExcept := false, false
+
+	rest := strings.TrimSpace(value)
+	for rest != "" {
+		var name string
+		name, rest = parseSFKey(rest)
+		if name == "" {
+			return queryRule{}, errInvalidNoVarySearch
+		}
+
+		boolean, list, isList := true, []string(nil), false
+		if strings.HasPrefix(rest, "=") {
+			known := name == "key-order" || name == "params" || name == "except"
+			if !known {
+				rest = skipSFItem(rest[1:])
+			} else {
+				var err error
+				boolean, list, isList, rest, err = parseSFItem(rest[1:])
+				if err != nil {
+					return queryRule{}, err
+				}
+			}
+		}
+		// The member parameters are not used.
+		for strings.HasPrefix(rest, ";") {
+			rest = strings.TrimLeft(rest[1:], " ")
+			_, rest = parseSFKey(rest)
+			if strings.HasPrefix(rest, "=") {
+				rest = skipSFItem(rest[1:])
+			}
+		}
+
+		switch name {
+		case "key-order":
+			if isList {
+				return queryRule{}, errInvalidNoVarySearch
+			}
+			rule.sort = boolean
+		case "params":
+			params, paramsAll = list, !isList && boolean
+		case "except":
+			if !isList {
+				return queryRule{}, errInvalidNoVarySearch
+			}
+			except, hasExcept = list, true
+		}
+
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, ",") {
+			return queryRule{}, errInvalidNoVarySearch
+		}
+		rest = strings.TrimLeft(rest[1:], " \t")
+		if rest == "" {
+			return queryRule{}, errInvalidNoVarySearch
+		}
+	}
+
+	if hasExcept && !paramsAll {
+		return queryRule{}, errInvalidNoVarySearch
+	}
+	for _, name := range params {
+		rule.ignore = append(rule.ignore, escapePattern(name))
+	}
+	if paramsAll {
+		rule.restrict = true
+		for _, name := range except {
+			rule.keep = append(rule.keep, escapePattern(name))
+		}
+	}
+
+	return rule, nil
+}
+
+// parseSFKey returns the structured field key at the beginning of the value.
+func parseSFKey(value string) (string, string) {
+	i := 0
+	for ; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c == '*' {
+			continue
+		}
+		if i == 0 || !(c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			break
+		}
+	}
+
+	return value[:i], value[i:]
+}
+
+// parseSFItem parses a boolean or an inner list of strings.
+func parseSFItem(value string) (boolean bool, list []string, isList bool, rest string, err error) {
+	switch {
+	case strings.HasPrefix(value, "?1"):
+		return true, nil, false, value[2:], nil
+	case strings.HasPrefix(value, "?0"):
+		return false, nil, false, value[2:], nil
+	case !strings.HasPrefix(value, "("):
+		return false, nil, false, value, errInvalidNoVarySearch
+	}
+
+	list = make([]string, 0)
+	rest = value[1:]
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(rest, ")") {
+			return false, list, true, rest[1:], nil
+		}
+		if !strings.HasPrefix(rest, `"`) {
+			return false, nil, false, rest, errInvalidNoVarySearch
+		}
+
+		var b strings.Builder
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' {
+				i++
+				if i == len(rest) || (rest[i] != '"' && rest[i] != '\\') {
+					return false, nil, false, rest, errInvalidNoVarySearch
+				}
+			}
+			b.WriteByte(rest[i])
+		}
+		if i == len(rest) {
+			return false, nil, false, rest, errInvalidNoVarySearch
+		}
+		list = append(list, b.String())
+		rest = rest[i+1:]
+		for strings.HasPrefix(rest, ";") {
+			_, rest = parseSFKey(strings.TrimLeft(rest[1:], " "))
+			if strings.HasPrefix(rest, "=") {
+				rest = skipSFItem(rest[1:])
+			}
+		}
+		if !strings.HasPrefix(rest, " ") && !strings.HasPrefix(rest, ")") {
+			return false, nil, false, rest, errInvalidNoVarySearch
+		}
+	}
+}
+
+// skipSFItem skips the unused item at the beginning of the value.
+func skipSFItem(value string) string {
+	depth, quoted := 0, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == ',' || c == ';' || c == ' ' || c == '\t'):
+			return value[i:]
+		}
+	}
+
+	return ""
+}
+
+// escapePattern escapes the pattern special characters of the name.
+func escapePattern(name string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(name)
+}
+
+// noVarySearchRules keeps the No-Vary-Search rule of the last upstream
+// response of each resource, to compute the key of the next requests.
+type noVarySearchRules struct {
+	mu    sync.RWMutex
+	rules map[string]queryRule
+}
+
+func newNoVarySearchRules() *noVarySearchRules {
+	return &noVarySearchRules{rules: make(map[string]queryRule)}
+}
+
+func resourceName(r *http.Request) string {
+	return r.Host + r.URL.Path
+}
+
+func (n *noVarySearchRules) get(r *http.Request) (queryRule, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	rule, ok := n.rules[resourceName(r)]
+
+	return rule, ok
+}
+
+// learn remembers the No-Vary-Search rule of the upstream response, an
+// absent or invalid header forgets the previous one.
+func (n *noVarySearchRules) learn(r *http.Request, header http.Header) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return
+	}
+
+	resource := resourceName(r)
+	rule, err := parseNoVarySearch(strings.Join(header.Values("No-Vary-Search"), ", "))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil || header.Get("No-Vary-Search") == "" {
+		delete(n.rules, resource)
+		return
+	}
+	if len(n.rules) >= maxNoVarySearchRules {
+		n.rules = make(map[string]queryRule)
+	}
+	n.rules[resource] = rule
+}
+
+// keyRequest returns the request handed to the Souin base handler, normalized
+// by the key and vary configuration and the No-Vary-Search rule of the
+// resource. The upstream still receives the original request.
+func (s *SouinCaddyMiddleware) keyRequest(r *http.Request) *http.Request {
+	host, path, query := r.Host, r.URL.Path, r.URL.RawQuery
+	if n := s.keyNormalize(r.RequestURI); n != nil {
+		host, path, query = n.apply(host, path, query)
+	}
+	if q := s.Configuration.DefaultCache.KeyQuery; q != nil && query != "" {
+		query = newQueryRule(q).apply(query)
+	}
+	if s.noVarySearch != nil && query != "" {
+		if rule, ok := s.noVarySearch.get(r); ok {
+			query = rule.apply(query)
+		}
+	}
+	headers := s.normalizedVaryHeaders(r, false)
+	if names := s.Configuration.DefaultCache.KeyCookies; len(names) > 0 {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[keyCookiesHeader] = keyCookies(r, names)
+	}
+	headers = s.privateKeyHeaders(r, headers)
+	kr := withHeaders(r, headers)
+	if host == r.Host && path == r.URL.Path && query == r.URL.RawQuery {
+		return kr
+	}
+
+	if kr == r {
+		kr = r.WithContext(r.Context())
+	}
+	u := *r.URL
+	if path != u.Path {
+		u.Path, u.RawPath = path, ""
+	}
+	u.RawQuery = query
+	kr.URL = &u
+	kr.Host = host
+
+	return kr
+}
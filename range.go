@@ -0,0 +1,327 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	// rangeField is the targeted field recorded when the partial response
+	// to a forwarded range is kept out of the storers.
+	rangeField = "range"
+	// maxUnstorableRanges bounds the number of resources whose ranges are
+	// forwarded, they are forgotten once it is reached.
+	maxUnstorableRanges = 10000
+
+	widenedRangeCtxKey ctxKey = "cache_handler.WIDENED_RANGE"
+)
+
+var errSeekBackward = errors.New("seek before the streamed position")
+
+// isRangeRequest returns whether the ranges of the request are served from
+// the complete cached response.
+func (s *SouinCaddyMiddleware) isRangeRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") != "" && s.isCachedMethod(r.Method)
+}
+
+// withWidenedRange records whether the ranges are removed from the request
+// forwarded to the upstream to store the complete response.
+func withWidenedRange(ctx context.Context, widened bool) context.Context {
+	return context.WithValue(ctx, widenedRangeCtxKey, widened)
+}
+
+// widenedRange returns the value given to withWidenedRange.
+func widenedRange(ctx context.Context) bool {
+	widened, _ := ctx.Value(widenedRangeCtxKey).(bool)
+
+	return widened
+}
+
+// widensRange returns whether the complete response is requested to the
+// upstream to be stored and serve the next ranges. The ranges of the
+// requests whose response is not stored are forwarded.
+func (s *SouinCaddyMiddleware) widensRange(r *http.Request) bool {
+	if !s.isRangeRequest(r) || (s.unstorableRanges != nil && s.unstorableRanges.has(r)) {
+		return false
+	}
+	if s.ExcludeRegex != nil && s.ExcludeRegex.MatchString(r.RequestURI) {
+		return false
+	}
+	requestCc, err := cacheobject.ParseRequestCacheControl(r.Header.Get("Cache-Control"))
+
+	return err == nil && !requestCc.NoStore
+}
+
+// keepRangeOut keeps the partial responses to the forwarded ranges out of
+// the storers.
+func (s *SouinCaddyMiddleware) keepRangeOut(r *http.Request, header http.Header, code int) {
+	if code == http.StatusPartialContent && s.isRangeRequest(r) && !widenedRange(r.Context()) {
+		s.overrideCacheControl(header, rangeField, "no-store")
+	}
+}
+
+// learnRange remembers whether the response fetched for the request has
+// been stored, the next ranges of the resource are forwarded when it has
+// not. header is the header of the response written by the Souin base
+// handler.
+func (s *SouinCaddyMiddleware) learnRange(r *http.Request, state *requestState, header http.Header) {
+	if r.Method != http.MethodGet || !s.isCachedMethod(r.Method) || s.unstorableRanges == nil {
+		return
+	}
+	if _, called := state.upstream(); !called || (s.isRangeRequest(r) && !widenedRange(r.Context())) {
+		return
+	}
+
+	_, stored := state.storedSize()
+	stored = stored || parseCacheStatus(header.Get("Cache-Status")).Stored
+	// Only the widened ranges teach an unstorable resource.
+	if stored || s.isRangeRequest(r) {
+		s.unstorableRanges.learn(r, stored)
+	}
+}
+
+// unstorableRanges keeps the resources whose complete response was not
+// stored when it was requested for a range.
+type unstorableRanges struct {
+	mu        sync.RWMutex
+	resources map[string]struct{}
+}
+
+func newUnstorableRanges() *unstorableRanges {
+	return &unstorableRanges{resources: make(map[string]struct{})}
+}
+
+func (u *unstorableRanges) has(r *http.Request) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	_, ok := u.resources[resourceName(r)]
+
+	return ok
+}
+
+func (u *unstorableRanges) learn(r *http.Request, storable bool) {
+	resource := resourceName(r)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if storable {
+		delete(u.resources, resource)
+		return
+	}
+	if len(u.resources) >= maxUnstorableRanges {
+		u.resources = make(map[string]struct{})
+	}
+	u.resources[resource] = struct{}{}
+}
+
+// rangeResponseWriter serves the requested ranges of the complete response
+// handed by the Souin base handler. When it is given the client, a single
+// range of a response with a known length is streamed and the responses
+// other than 200 are written as is, the other ones are buffered.
+type rangeResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	chunks *chunkStore
+	client http.ResponseWriter
+	r      *http.Request
+	// Whether the response is written as is to the client.
+	passthrough bool
+	// Pipe read by the goroutine streaming the ranges.
+	pipe *io.PipeWriter
+	done chan struct{}
+}
+
+func newRangeResponseWriter(chunks *chunkStore) *rangeResponseWriter {
+	return &rangeResponseWriter{header: http.Header{}, chunks: chunks}
+}
+
+// streamTo records the client the ranges of the request are streamed to.
+func (w *rangeResponseWriter) streamTo(client http.ResponseWriter, r *http.Request) {
+	w.client, w.r = client, r
+}
+
+func (w *rangeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rangeResponseWriter) WriteHeader(code int) {
+	if w.status != 0 || code < http.StatusOK {
+		return
+	}
+	w.status = code
+	if w.client == nil || w.header.Get(chunksHeader) != "" {
+		return
+	}
+
+	ranges := w.r.Header.Get("Range")
+	if code != http.StatusOK || !strings.HasPrefix(ranges, "bytes=") {
+		w.copyHeader()
+		w.passthrough = true
+		w.client.WriteHeader(code)
+		return
+	}
+	size, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64)
+	// The content type is not sniffed from a streamed response.
+	if err != nil || size < 0 || strings.Contains(ranges, ",") || len(w.header.Values("Content-Type")) == 0 {
+		return
+	}
+
+	w.copyHeader()
+	reader, pipe := io.Pipe()
+	w.pipe, w.done = pipe, make(chan struct{})
+	rq, modified := w.rangeRequest()
+	go func() {
+		defer close(w.done)
+		http.ServeContent(w.client, rq, "", modified, &streamReader{r: reader, size: size})
+		// The rest of the response is still written by the Souin base
+		// handler.
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+}
+
+func (w *rangeResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.passthrough:
+		return w.client.Write(b)
+	case w.pipe != nil:
+		return w.pipe.Write(b)
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *rangeResponseWriter) copyHeader() {
+	for name, values := range w.header {
+		w.client.Header()[name] = values
+	}
+}
+
+// rangeRequest returns the request the ranges are served for and the last
+// modification of the response. The conditions other than If-Range have
+// already been evaluated.
+func (w *rangeResponseWriter) rangeRequest() (*http.Request, time.Time) {
+	rq := w.r.Clone(w.r.Context())
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		rq.Header.Del(name)
+	}
+	modified, _ := time.Parse(http.TimeFormat, w.header.Get("Last-Modified"))
+
+	return rq, modified
+}
+
+// close waits for the streamed ranges to be sent.
+func (w *rangeResponseWriter) close() {
+	if w.pipe == nil {
+		return
+	}
+	_ = w.pipe.Close()
+	<-w.done
+	w.pipe = nil
+}
+
+// serve writes the requested ranges of a complete response, with the 206 or
+// 416 status, the other responses are written as is. The ranges of a
+// response stored as chunks are read from its chunks.
+func (w *rangeResponseWriter) serve(s *SouinCaddyMiddleware, rw http.ResponseWriter, r *http.Request) error {
+	if w.passthrough || w.pipe != nil {
+		w.close()
+		return nil
+	}
+	marker := w.header.Get(chunksHeader)
+	w.header.Del(chunksHeader)
+	for name, values := range w.header {
+		rw.Header()[name] = values
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	var content io.ReadSeeker = bytes.NewReader(w.body.Bytes())
+	var chunks *chunkReader
+	if marker != "" {
+		m, err := parseChunkManifest(marker, w.body.Bytes())
+		if err != nil || w.chunks == nil {
+			rw.Header().Del("Content-Length")
+			rw.WriteHeader(http.StatusBadGateway)
+			return nil
+		}
+		if w.status != http.StatusOK {
+			rw.WriteHeader(w.status)
+			return nil
+		}
+		rw.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+		chunks = w.chunks.reader(m)
+		content = chunks
+	}
+	if w.status != http.StatusOK || !strings.HasPrefix(r.Header.Get("Range"), "bytes=") {
+		rw.WriteHeader(w.status)
+		_, err := io.Copy(rw, content)
+		return err
+	}
+
+	w.r = r
+	rq, modified := w.rangeRequest()
+	http.ServeContent(rw, rq, "", modified, content)
+	if chunks != nil && chunks.err != nil {
+		s.purgeChunked(r)
+		return chunks.err
+	}
+
+	return nil
+}
+
+// streamReader reads the response written by the Souin base handler while
+// it is served, it only seeks forward and knows the length of the response.
+type streamReader struct {
+	r      io.Reader
+	size   int64
+	offset int64
+	read   int64
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if sr.read < sr.offset {
+		n, err := io.CopyN(io.Discard, sr.r, sr.offset-sr.read)
+		sr.read += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := sr.r.Read(p)
+	sr.read += int64(n)
+	sr.offset = sr.read
+
+	return n, err
+}
+
+func (sr *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < sr.read {
+		return 0, errSeekBackward
+	}
+	sr.offset = offset
+
+	return offset, nil
+}
+
+var _ http.ResponseWriter = (*rangeResponseWriter)(nil)
@@ -0,0 +1,23 @@
+package httpcache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient returns a client of the Redis server at the address, either
+// host:port or redis://[[user]:password@]host:port[/db].
+func newRedisClient(address string) (*redis.Client, error) {
+	if !strings.Contains(address, "://") {
+		return redis.NewClient(&redis.Options{Addr: address}), nil
+	}
+
+	opt, err := redis.ParseURL(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis address %s: %w", address, err)
+	}
+
+	return redis.NewClient(opt), nil
+}
@@ -0,0 +1,111 @@
+package httpcache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	defaultRefreshAheadThreshold = 10
+	defaultRefreshAheadMinHits   = 5
+
+	// Number of tracked entries before the expired ones are swept.
+	hotEntriesSweep = 1024
+
+	refreshPerformed = "performed"
+	refreshSkipped   = "skipped"
+)
+
+// hotEntry counts the hits of a stored response until it expires.
+type hotEntry struct {
+	hits    int
+	expires time.Time
+}
+
+// hotEntries tracks the hits of the stored responses by storage key.
+type hotEntries struct {
+	mu        sync.Mutex
+	entries   map[string]*hotEntry
+	nextSweep int
+}
+
+func newHotEntries() *hotEntries {
+	return &hotEntries{
+		entries:   map[string]*hotEntry{},
+		nextSweep: hotEntriesSweep,
+	}
+}
+
+// hit counts a hit on the response stored under the key and returns the
+// hits of the response. The count restarts when the response is replaced.
+func (h *hotEntries) hit(key string, expires time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry, ok := h.entries[key]
+	if !ok || !entry.expires.Equal(expires) {
+		entry = &hotEntry{expires: expires}
+		h.entries[key] = entry
+	}
+	entry.hits++
+
+	if len(h.entries) >= h.nextSweep {
+		now := time.Now()
+		for k, e := range h.entries {
+			if e.expires.Before(now) {
+				delete(h.entries, k)
+			}
+		}
+		h.nextSweep = max(2*len(h.entries), hotEntriesSweep)
+	}
+
+	return entry.hits
+}
+
+func (h *hotEntries) forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.entries, key)
+}
+
+// refreshAhead schedules the refresh of the fresh response served to the
+// client when it is in the last part of its TTL and has been requested
+// enough times.
+func (s *SouinCaddyMiddleware) refreshAhead(r *http.Request, next caddyhttp.Handler, header http.Header, served *servedEntry) {
+	cfg := s.Configuration.DefaultCache.RefreshAhead
+	storageKey, expires, ttl, found := served.fresh()
+	if cfg == nil || !found || parseCacheStatus(header.Get("Cache-Status")).Outcome != outcomeHit {
+		return
+	}
+
+	threshold, minHits := cfg.Threshold, cfg.MinHits
+	if threshold == 0 {
+		threshold = defaultRefreshAheadThreshold
+	}
+	if minHits == 0 {
+		minHits = defaultRefreshAheadMinHits
+	}
+
+	hits := s.hotEntries.hit(storageKey, expires)
+	if time.Until(expires) > time.Duration(float64(ttl)*threshold/100) {
+		return
+	}
+
+	if hits < minHits {
+		s.observeRefreshAhead(r, refreshSkipped)
+		return
+	}
+
+	if !s.refreshInBackground(r, next, storageKey, func(err error) {
+		if err == nil {
+			s.observeRefreshAhead(r, refreshPerformed)
+		}
+	}) {
+		s.observeRefreshAhead(r, refreshSkipped)
+		return
+	}
+	s.hotEntries.forget(storageKey)
+}
@@ -0,0 +1,152 @@
+package httpcache
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ctxKey string
+
+const requestStateCtxKey ctxKey = "cache_handler.REQUEST_STATE"
+
+// requestState collects what happened to a request while the Souin base
+// handler processed it. It is shared through the request context with the
+// next handler wrapper and the instrumented storers.
+type requestState struct {
+	mu              sync.Mutex
+	upstreamCalled  bool
+	upstreamLatency time.Duration
+	found           bool
+	lookupEnd       time.Time
+	storageKey      string
+	store           *pendingStore
+	// Size of the bodies stored by storer.
+	stored map[string]int64
+}
+
+// pendingStore describes the request whose upstream response is about to be
+// written in the storers under a storage key.
+type pendingStore struct {
+	// Context of the upstream span, the store spans are attached to it.
+	ctx   context.Context
+	key   string
+	host  string
+	route string
+	// State of the request the response is stored for.
+	state *requestState
+}
+
+func withRequestState(r *http.Request) (*http.Request, *requestState) {
+	state := &requestState{}
+
+	return r.WithContext(context.WithValue(r.Context(), requestStateCtxKey, state)), state
+}
+
+func requestStateFromContext(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestStateCtxKey).(*requestState)
+
+	return state
+}
+
+// trackUpstream measures the time spent in the next handler.
+func (st *requestState) trackUpstream() func() {
+	start := time.Now()
+
+	return func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.upstreamCalled = true
+		st.upstreamLatency = time.Since(start)
+	}
+}
+
+// upstream returns the time spent in the next handler and if it was called.
+func (st *requestState) upstream() (time.Duration, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.upstreamLatency, st.upstreamCalled
+}
+
+// lookedUp records the result of a storer lookup.
+func (st *requestState) lookedUp(found bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.found = st.found || found
+	st.lookupEnd = time.Now()
+}
+
+// lookup returns if an entry was found in the storers and when the last lookup ended.
+func (st *requestState) lookup() (bool, time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.found, st.lookupEnd
+}
+
+// setPendingStore records the response about to be stored under the storage key.
+func (st *requestState) setPendingStore(storageKey string, store *pendingStore) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.storageKey = storageKey
+	st.store = store
+}
+
+// pendingStore returns the storage key and the response given to setPendingStore.
+func (st *requestState) pendingStore() (string, *pendingStore) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.storageKey, st.store
+}
+
+// absorb accounts what was done for a slice of the request.
+func (st *requestState) absorb(slice *requestState) {
+	latency, called := slice.upstream()
+	stored := slice.storedSizes()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.upstreamCalled = st.upstreamCalled || called
+	st.upstreamLatency += latency
+	for storer, size := range stored {
+		if st.stored == nil {
+			st.stored = make(map[string]int64)
+		}
+		st.stored[storer] += size
+	}
+}
+
+// addStored records the size of a body stored in the storer.
+func (st *requestState) addStored(storer string, size int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stored == nil {
+		st.stored = make(map[string]int64)
+	}
+	st.stored[storer] += size
+}
+
+// storedSizes returns the size of the bodies stored by storer.
+func (st *requestState) storedSizes() map[string]int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return maps.Clone(st.stored)
+}
+
+// storedSize returns the size of the bodies stored for the request, they
+// are the same in every storer.
+func (st *requestState) storedSize() (int64, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var size int64
+	for _, s := range st.stored {
+		size = max(size, s)
+	}
+
+	return size, len(st.stored) > 0
+}
@@ -0,0 +1,277 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/darkweak/souin/pkg/rfc"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	defaultRevalidationWorkers = 4
+	defaultRevalidationQueue   = 100
+
+	backgroundRevalidationDetail = "BACKGROUND-REVALIDATION"
+)
+
+// revalidator refreshes the stale responses in background with a bounded
+// pool of workers. Only one refresh per key can be pending at once.
+type revalidator struct {
+	mu       sync.RWMutex
+	queue    chan revalidation
+	inflight sync.Map
+	done     chan struct{}
+	stopped  bool
+}
+
+// revalidation is a refresh waiting for a worker.
+type revalidation struct {
+	key     string
+	refresh func()
+}
+
+func newRevalidator(cfg *StaleWhileRevalidate) *revalidator {
+	workers, queue := defaultRevalidationWorkers, defaultRevalidationQueue
+	if cfg != nil && cfg.Workers > 0 {
+		workers = cfg.Workers
+	}
+	if cfg != nil && cfg.Queue > 0 {
+		queue = cfg.Queue
+	}
+
+	rv := &revalidator{
+		queue: make(chan revalidation, queue),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go rv.work()
+	}
+
+	return rv
+}
+
+func (rv *revalidator) work() {
+	for {
+		select {
+		case <-rv.done:
+			return
+		case pending := <-rv.queue:
+			pending.refresh()
+		}
+	}
+}
+
+// schedule queues the refresh of the key unless one is already pending.
+// It returns false when the queue is full or the revalidator is stopped.
+func (rv *revalidator) schedule(key string, refresh func()) bool {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+	if rv.stopped {
+		return false
+	}
+	if _, pending := rv.inflight.LoadOrStore(key, struct{}{}); pending {
+		return true
+	}
+
+	select {
+	case rv.queue <- revalidation{key: key, refresh: func() {
+		defer rv.inflight.Delete(key)
+		refresh()
+	}}:
+		return true
+	default:
+		rv.inflight.Delete(key)
+
+		return false
+	}
+}
+
+// stop stops the workers and drops the refreshes still queued.
+func (rv *revalidator) stop() {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.stopped {
+		return
+	}
+	rv.stopped = true
+	close(rv.done)
+	for {
+		select {
+		case pending := <-rv.queue:
+			rv.inflight.Delete(pending.key)
+		default:
+			return
+		}
+	}
+}
+
+// withinStaleWhileRevalidate returns whether the stale response can still
+// be served while it is refreshed, as defined in RFC 5861.
+func withinStaleWhileRevalidate(res *http.Response) bool {
+	cc, err := cacheobject.ParseResponseCacheControl(rfc.HeaderAllCommaSepValuesString(res.Header, "Cache-Control"))
+	if err != nil || cc.StaleWhileRevalidate <= 0 {
+		return false
+	}
+
+	expires, _, ok := storedExpiry(res)
+
+	return ok && time.Since(expires) <= time.Duration(cc.StaleWhileRevalidate)*time.Second
+}
+
+const servedEntryCtxKey ctxKey = "cache_handler.SERVED_ENTRY"
+
+// servedEntry records the response the storers served for the request.
+type servedEntry struct {
+	mu sync.Mutex
+	// Whether a stale response within its stale-while-revalidate window can
+	// be served as fresh, and the storage key of the promoted response.
+	allowStale        bool
+	staleKey          string
+	staleCacheControl []string
+	// Storage key, expiration and freshness lifetime of the fresh response
+	// found in the storers.
+	freshKey     string
+	freshExpires time.Time
+	freshTTL     time.Duration
+}
+
+func withServedEntry(ctx context.Context, allowStale bool) (context.Context, *servedEntry) {
+	served := &servedEntry{allowStale: allowStale}
+
+	return context.WithValue(ctx, servedEntryCtxKey, served), served
+}
+
+func servedEntryFromContext(ctx context.Context) *servedEntry {
+	served, _ := ctx.Value(servedEntryCtxKey).(*servedEntry)
+
+	return served
+}
+
+// promoteStale returns whether the stale response stored under the storage
+// key can be served while it is refreshed in background.
+func (se *servedEntry) promoteStale(storageKey string, stale *http.Response) bool {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if !se.allowStale || se.staleKey != "" || !withinStaleWhileRevalidate(stale) {
+		return false
+	}
+	se.staleKey = storageKey
+	// The Souin base handler rejects the responses older than their
+	// max-age, the Cache-Control header is restored before being sent.
+	se.staleCacheControl = stale.Header.Values("Cache-Control")
+	stale.Header.Del("Cache-Control")
+
+	return true
+}
+
+// promotedStale returns the storage key and the Cache-Control header of the
+// stale response served as fresh.
+func (se *servedEntry) promotedStale() (string, []string, bool) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	return se.staleKey, se.staleCacheControl, se.staleKey != ""
+}
+
+// foundFresh records the fresh response found under the storage key.
+func (se *servedEntry) foundFresh(storageKey string, fresh *http.Response) {
+	expires, ttl, ok := storedExpiry(fresh)
+	if !ok {
+		return
+	}
+
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if se.freshKey == "" {
+		se.freshKey, se.freshExpires, se.freshTTL = storageKey, expires, ttl
+	}
+}
+
+// fresh returns the storage key, expiration and freshness lifetime of the
+// fresh response found in the storers.
+func (se *servedEntry) fresh() (string, time.Time, time.Duration, bool) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	return se.freshKey, se.freshExpires, se.freshTTL, se.freshKey != ""
+}
+
+// storedExpiry returns when the stored response expires and its freshness
+// lifetime, computed by the Souin base handler when it has been stored.
+func storedExpiry(res *http.Response) (time.Time, time.Duration, bool) {
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	ttl, err := time.ParseDuration(res.Header.Get(rfc.StoredTTLHeader))
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return date.Add(ttl), ttl, true
+}
+
+// revalidationRequest prepares a request detached from the client one to
+// refresh the stored response through the next handler.
+func revalidationRequest(r *http.Request, w http.ResponseWriter) *http.Request {
+	rq := r.Clone(context.WithoutCancel(r.Context()))
+	for _, h := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"} {
+		rq.Header.Del(h)
+	}
+	rq.Header.Set("Cache-Control", "no-cache")
+
+	// The client request replacer and variables are still used to log
+	// the client request, the refresh gets its own.
+	srv, _ := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+
+	return caddyhttp.PrepareRequest(rq, caddy.NewReplacer(), w, srv)
+}
+
+// revalidateInBackground schedules the refresh of the stale response served
+// to the client and flags it in the Cache-Status header.
+func (s *SouinCaddyMiddleware) revalidateInBackground(r *http.Request, next caddyhttp.Handler, header http.Header, served *servedEntry) {
+	storageKey, cacheControl, promoted := served.promotedStale()
+	if !promoted || parseCacheStatus(header.Get("Cache-Status")).Outcome != outcomeHit {
+		return
+	}
+	header["Cache-Control"] = cacheControl
+
+	status := header.Get("Cache-Status") + "; fwd=stale"
+	if s.refreshInBackground(r, next, storageKey, nil) {
+		status += "; detail=" + backgroundRevalidationDetail
+	} else {
+		s.logger.Debugf("Background revalidation queue is full, skip the refresh of %s", storageKey)
+	}
+	header.Set("Cache-Status", status)
+}
+
+// refreshInBackground schedules the refresh of the response stored under the
+// storage key through the next handler, done is called once it has been
+// refreshed. It returns false when the queue is full.
+func (s *SouinCaddyMiddleware) refreshInBackground(r *http.Request, next caddyhttp.Handler, storageKey string, done func(error)) bool {
+	return s.revalidator.schedule(storageKey, func() {
+		w := newDiscardResponseWriter()
+		rq, state := withRequestState(revalidationRequest(r, w))
+		// The states of the client request are inherited from its context.
+		ctx, _ := withServedEntry(rq.Context(), false)
+		ctx, _ = withChunkStream(ctx, nil)
+		rq = rq.WithContext(ctx)
+		coalescing := &coalescingState{}
+		defer s.landFlight(coalescing, state, w.Header())
+		err := s.SouinBaseHandler.ServeHTTP(w, s.keyRequest(rq), s.upstream(rq, next, state, coalescing, false))
+		if err != nil {
+			s.logger.Debugf("Background refresh of %s failed: %v", storageKey, err)
+		}
+		s.learnRange(rq, state, w.Header())
+		s.releasePendingStore(state)
+		coalescing.unlock()
+		if done != nil {
+			done(err)
+		}
+	})
+}
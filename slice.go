@@ -0,0 +1,206 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/darkweak/souin/configurationtypes"
+)
+
+// sliceHeader carries the range of the slice requested to the upstream, it
+// is part of the key when slice is enabled.
+const sliceHeader = "Cache-Handler-Slice"
+
+var errSliceMismatch = errors.New("the slice does not match the first slice of the response")
+
+// isSliceRequest returns whether the response is assembled from slices.
+func (s *SouinCaddyMiddleware) isSliceRequest(r *http.Request) bool {
+	return s.Configuration.DefaultCache.Slice > 0 && r.Method == http.MethodGet &&
+		s.isCachedMethod(r.Method) && r.Header.Get(sliceHeader) == ""
+}
+
+// withKeyHeader adds the header to the key headers of the global key and of
+// the cache_keys overrides.
+func withKeyHeader(c *Configuration, header string) {
+	if !slices.Contains(c.DefaultCache.Key.Headers, header) {
+		c.DefaultCache.Key.Headers = append(slices.Clone(c.DefaultCache.Key.Headers), header)
+	}
+
+	cacheKeys := make(configurationtypes.CacheKeys, 0, len(c.CacheKeys))
+	for _, cacheKey := range c.CacheKeys {
+		override := configurationtypes.CacheKey{}
+		for pattern, key := range cacheKey {
+			if !slices.Contains(key.Headers, header) {
+				key.Headers = append(slices.Clone(key.Headers), header)
+			}
+			override[pattern] = key
+		}
+		cacheKeys = append(cacheKeys, override)
+	}
+	c.CacheKeys = cacheKeys
+}
+
+// parseContentRange returns the first byte position and the complete length
+// of a single part Content-Range header.
+func parseContentRange(value string) (start int64, size int64, ok bool) {
+	positions, length, found := strings.Cut(strings.TrimPrefix(value, "bytes "), "/")
+	if !found || !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(positions, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size, err = strconv.ParseInt(length, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	return start, size, true
+}
+
+// fetchSlice serves the slice from the cache or from the upstream, what it
+// did is accounted in the state of the client request.
+func (s *SouinCaddyMiddleware) fetchSlice(r *http.Request, next caddyhttp.Handler, index int64, state *requestState) (*rangeResponseWriter, error) {
+	size := int64(s.Configuration.DefaultCache.Slice)
+	rq := r.Clone(r.Context())
+	rq.Header.Del("Range")
+	rq.Header.Del("If-Range")
+	if index > 0 {
+		// The conditions are evaluated with the first slice.
+		for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+			rq.Header.Del(name)
+		}
+	}
+	rq.Header.Set(sliceHeader, fmt.Sprintf("bytes=%d-%d", index*size, (index+1)*size-1))
+
+	w := newRangeResponseWriter(nil)
+	rq, sliceState := withRequestState(rq)
+	err := s.serveEntry(newCacheResponseWriter(w), rq, next, sliceState)
+	state.absorb(sliceState)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w, err
+}
+
+// sliceReader reads the response slice by slice, only the current slice is
+// kept in memory.
+type sliceReader struct {
+	s      *SouinCaddyMiddleware
+	r      *http.Request
+	next   caddyhttp.Handler
+	state  *requestState
+	size   int64
+	etag   string
+	offset int64
+	index  int64
+	slice  []byte
+	err    error
+}
+
+func (sr *sliceReader) Read(p []byte) (int, error) {
+	if sr.offset >= sr.size {
+		return 0, io.EOF
+	}
+	sliceSize := int64(sr.s.Configuration.DefaultCache.Slice)
+	index := sr.offset / sliceSize
+	if index != sr.index {
+		w, err := sr.s.fetchSlice(sr.r, sr.next, index, sr.state)
+		if err != nil {
+			sr.err = err
+			return 0, err
+		}
+		start, size, ok := parseContentRange(w.header.Get("Content-Range"))
+		if w.status != http.StatusPartialContent || !ok || start != index*sliceSize || size != sr.size ||
+			(sr.etag != "" && w.header.Get("Etag") != sr.etag) {
+			sr.err = errSliceMismatch
+			return 0, sr.err
+		}
+		sr.index, sr.slice = index, w.body.Bytes()
+	}
+	start := sr.offset - index*sliceSize
+	if start >= int64(len(sr.slice)) {
+		sr.err = errSliceMismatch
+		return 0, sr.err
+	}
+	n := copy(p, sr.slice[start:])
+	sr.offset += int64(n)
+
+	return n, nil
+}
+
+func (sr *sliceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	sr.offset = offset
+
+	return offset, nil
+}
+
+// serveSlices assembles the response or the requested ranges from the
+// slices, the first slice gives the complete length of the response.
+func (s *SouinCaddyMiddleware) serveSlices(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler, state *requestState) error {
+	first, err := s.fetchSlice(r, next, 0, state)
+	if err != nil {
+		return err
+	}
+	start, size, ok := parseContentRange(first.header.Get("Content-Range"))
+	if first.status != http.StatusPartialContent || !ok || start != 0 {
+		// The upstream ignored the range, its response is served as is.
+		return first.serve(s, rw, r)
+	}
+
+	header := rw.Header()
+	for name, values := range first.header {
+		if name != "Content-Range" && name != "Content-Length" {
+			header[name] = values
+		}
+	}
+	reader := &sliceReader{
+		s:     s,
+		r:     r,
+		next:  next,
+		state: state,
+		size:  size,
+		etag:  first.header.Get("Etag"),
+		slice: bytes.Clone(first.body.Bytes()),
+	}
+
+	// The conditions other than If-Range have been evaluated with the first
+	// slice.
+	rq := r.Clone(r.Context())
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		rq.Header.Del(name)
+	}
+	modified, _ := time.Parse(http.TimeFormat, first.header.Get("Last-Modified"))
+	http.ServeContent(rw, rq, "", modified, reader)
+	if reader.err != nil {
+		s.logger.Warnf("Impossible to serve the slices of %s: %v", r.RequestURI, reader.err)
+	}
+
+	return nil
+}
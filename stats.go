@@ -0,0 +1,225 @@
+package httpcache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/darkweak/souin/pkg/storage/types"
+)
+
+// maxStatsEntries bounds the number of stored keys whose owner is kept per
+// storer.
+const maxStatsEntries = 100000
+
+// statsCounters are the cache statistics of a host, a route or a storer.
+type statsCounters struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Stale       uint64 `json:"stale"`
+	Bypass      uint64 `json:"bypass"`
+	ServedBytes uint64 `json:"served_bytes"`
+	StoredBytes uint64 `json:"stored_bytes"`
+	Entries     int    `json:"entries"`
+}
+
+func (c *statsCounters) add(outcome string) {
+	switch outcome {
+	case outcomeHit:
+		c.Hits++
+	case outcomeMiss:
+		c.Misses++
+	case outcomeStale:
+		c.Stale++
+	case outcomeBypass:
+		c.Bypass++
+	}
+}
+
+// entryOwner is the host and the route that stored a cache entry.
+type entryOwner struct {
+	host  string
+	route string
+}
+
+// statsReport is the body of the stats admin endpoint.
+type statsReport struct {
+	Since   time.Time                 `json:"since"`
+	Hosts   map[string]*statsCounters `json:"hosts"`
+	Routes  map[string]*statsCounters `json:"routes"`
+	Storers map[string]*statsCounters `json:"storers"`
+}
+
+// stats aggregates the cache statistics of every cache handler. Like the
+// metrics, they are kept across the configuration reloads.
+type stats struct {
+	mu      sync.Mutex
+	since   time.Time
+	hosts   map[string]*statsCounters
+	routes  map[string]*statsCounters
+	storers map[string]*statsCounters
+	// Owner of the stored entries by storer and key, to count the current
+	// entries of the hosts and the routes.
+	entries map[string]map[string]entryOwner
+}
+
+var cacheStats = newStats()
+
+func newStats() *stats {
+	st := &stats{entries: map[string]map[string]entryOwner{}}
+	st.reset()
+
+	return st
+}
+
+// reset clears the counters, the current entries are kept.
+func (st *stats) reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.since = time.Now()
+	st.hosts = map[string]*statsCounters{}
+	st.routes = map[string]*statsCounters{}
+	st.storers = map[string]*statsCounters{}
+}
+
+func counters(m map[string]*statsCounters, name string) *statsCounters {
+	c, ok := m[name]
+	if !ok {
+		c = &statsCounters{}
+		m[name] = c
+	}
+
+	return c
+}
+
+// addEntry records the host and the route that stored the key in the storer.
+// The previous owner is kept when the response is stored outside a request,
+// e.g. on background revalidation. The new keys are not recorded once the
+// storer has maxStatsEntries owned keys, the owners of the expired entries
+// are forgotten when the statistics are reported.
+func (st *stats) addEntry(storer, key, host, route string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys, ok := st.entries[storer]
+	if !ok {
+		keys = map[string]entryOwner{}
+		st.entries[storer] = keys
+	}
+	_, exists := keys[key]
+	if host == "" && route == "" && exists {
+		return
+	}
+	if !exists && len(keys) >= maxStatsEntries {
+		return
+	}
+	keys[key] = entryOwner{host: host, route: route}
+}
+
+// removeEntry forgets the owner of the key purged from the storer.
+func (st *stats) removeEntry(storer, key string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.entries[storer], key)
+}
+
+// pruneLocked forgets the owners of the expired and purged entries, keys are
+// the ones listed by the storer.
+func (st *stats) pruneLocked(storer string, keys []string) map[string]entryOwner {
+	owners := st.entries[storer]
+	current := make(map[string]entryOwner, len(keys))
+	for _, key := range keys {
+		if owner, ok := owners[key]; ok {
+			current[key] = owner
+		}
+	}
+	st.entries[storer] = current
+
+	return current
+}
+
+// record updates the statistics with the result of a request, served is the
+// size of the response sent to the client and stored the size of the bodies
+// stored by storer.
+func (st *stats) record(host, route string, result cacheResult, served int64, stored map[string]int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	h, rt := counters(st.hosts, host), counters(st.routes, route)
+	h.add(result.Outcome)
+	rt.add(result.Outcome)
+	if result.Storer != "" {
+		counters(st.storers, result.Storer).add(result.Outcome)
+	}
+
+	if result.Outcome == outcomeHit || result.Outcome == outcomeStale {
+		h.ServedBytes += uint64(served)
+		rt.ServedBytes += uint64(served)
+		if result.Storer != "" {
+			counters(st.storers, result.Storer).ServedBytes += uint64(served)
+		}
+	}
+
+	for storer, size := range stored {
+		h.StoredBytes += uint64(size)
+		rt.StoredBytes += uint64(size)
+		counters(st.storers, storer).StoredBytes += uint64(size)
+	}
+}
+
+// report returns a snapshot of the statistics, the current entries are
+// counted from the keys listed by the storers.
+func (st *stats) report(storers []types.Storer) statsReport {
+	listed := make(map[string][]string, len(storers))
+	for _, storer := range storers {
+		listed[storer.Name()] = storer.ListKeys()
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rp := statsReport{
+		Since:   st.since,
+		Hosts:   map[string]*statsCounters{},
+		Routes:  map[string]*statsCounters{},
+		Storers: map[string]*statsCounters{},
+	}
+	for name, c := range st.hosts {
+		cp := *c
+		cp.Entries = 0
+		rp.Hosts[name] = &cp
+	}
+	for name, c := range st.routes {
+		cp := *c
+		cp.Entries = 0
+		rp.Routes[name] = &cp
+	}
+	for name, c := range st.storers {
+		cp := *c
+		rp.Storers[name] = &cp
+	}
+
+	for name, keys := range listed {
+		counters(rp.Storers, name).Entries = len(keys)
+
+		for _, owner := range st.pruneLocked(name, keys) {
+			if owner.host != "" {
+				counters(rp.Hosts, owner.host).Entries++
+			}
+			if owner.route != "" {
+				counters(rp.Routes, owner.route).Entries++
+			}
+		}
+	}
+
+	return rp
+}
+
+// recordStats updates the cache statistics with the request result.
+func (s *SouinCaddyMiddleware) recordStats(r *http.Request, result cacheResult, crw *cacheResponseWriter, state *requestState) {
+	cacheStats.record(r.Host, s.routeName(r), result, crw.Size(), state.storedSizes())
+}
+
+// routeName identifies the cache handler instance in the statistics.
+func (s *SouinCaddyMiddleware) routeName(r *http.Request) string {
+	return s.serverName(r) + "/" + s.route
+}
@@ -0,0 +1,65 @@
+package httpcache
+
+import (
+	"strings"
+)
+
+const (
+	outcomeHit    = "hit"
+	outcomeMiss   = "miss"
+	outcomeStale  = "stale"
+	outcomeBypass = "bypass"
+)
+
+// cacheResult is the outcome of a request going through the cache
+// handler, extracted from the Cache-Status response header.
+type cacheResult struct {
+	// One of hit, miss, stale or bypass.
+	Outcome string
+	// The cache key, masked when the key is hidden.
+	Key string
+	// The storer that served the response on hit.
+	Storer string
+	// The detail part of the Cache-Status header.
+	Detail string
+	// Whether the response has been stored.
+	Stored bool
+}
+
+// parseCacheStatus extracts the cache result from the Cache-Status
+// header value written by the Souin base handler, e.g.
+// Souin; hit; ttl=119; key=GET-http-example.com-/; detail=DEFAULT
+func parseCacheStatus(value string) cacheResult {
+	result := cacheResult{Outcome: outcomeBypass}
+	if value == "" {
+		return result
+	}
+
+	parts := strings.Split(value, "; ")
+	for _, part := range parts[1:] {
+		switch {
+		case part == "hit":
+			result.Outcome = outcomeHit
+		case part == "stored":
+			result.Stored = true
+		case part == "fwd=stale":
+			result.Outcome = outcomeStale
+		case part == "fwd=bypass":
+			result.Outcome = outcomeBypass
+		case part == "fwd=uri-miss", part == "fwd=request":
+			result.Outcome = outcomeMiss
+		case strings.HasPrefix(part, "key="):
+			result.Key = strings.TrimPrefix(part, "key=")
+		case strings.HasPrefix(part, "detail=") && result.Detail == "":
+			// The first detail is the storer on hit, e.g. when the stale
+			// response is revalidated in background.
+			result.Detail = strings.TrimPrefix(part, "detail=")
+		}
+	}
+
+	if result.Outcome == outcomeHit || result.Outcome == outcomeStale {
+		result.Storer = result.Detail
+	}
+
+	return result
+}
@@ -0,0 +1,167 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/darkweak/souin/pkg/storage/types"
+	"github.com/darkweak/storages/core"
+)
+
+// instrumentedStorer decorates a storer to observe its operations.
+type instrumentedStorer struct {
+	types.Storer
+	server  func(*http.Request) string
+	handler string
+	// Responses about to be stored by storage key.
+	pending *sync.Map
+	// Mappings the Souin base handler must not delete.
+	kept *keptMappings
+}
+
+func newInstrumentedStorers(storers []types.Storer, server func(*http.Request) string, handler string, pending *sync.Map, kept *keptMappings) []types.Storer {
+	instrumented := make([]types.Storer, 0, len(storers))
+	for _, storer := range storers {
+		if i, ok := storer.(*instrumentedStorer); ok {
+			storer = i.Storer
+		}
+		instrumented = append(instrumented, &instrumentedStorer{
+			Storer:  storer,
+			server:  server,
+			handler: handler,
+			pending: pending,
+			kept:    kept,
+		})
+	}
+
+	return instrumented
+}
+
+func (i *instrumentedStorer) observe(r *http.Request, operation string, start time.Time) {
+	if cacheMetrics.storageLatency == nil {
+		return
+	}
+
+	cacheMetrics.storageLatency.WithLabelValues(i.server(r), i.handler, i.Name(), operation).Observe(time.Since(start).Seconds())
+}
+
+// GetMultiLevel observes and traces the lookup.
+func (i *instrumentedStorer) GetMultiLevel(key string, req *http.Request, validator *core.Revalidator) (fresh *http.Response, stale *http.Response) {
+	defer i.observe(req, "get", time.Now())
+	cacheKey, _ := storageKeyFromContext(req)
+	_, span := startSpan(req.Context(), spanLookup, attrStorer.String(i.Name()), keyHash(cacheKey))
+	defer span.End()
+
+	state := requestStateFromContext(req.Context())
+	if isRefresh(req.Context()) {
+		// The request carries the refresh token, the response is fetched
+		// and stored again.
+		span.SetAttributes(attrStatus.String("refresh"))
+		if state != nil {
+			state.lookedUp(false)
+		}
+
+		return nil, nil
+	}
+
+	fresh, stale = i.Storer.GetMultiLevel(key, req, validator)
+	if stale != nil && !withinStale(stale) {
+		stale = nil
+	}
+	served := servedEntryFromContext(req.Context())
+	promoted := fresh == nil && stale != nil && served != nil && served.promoteStale(key, stale)
+	if promoted {
+		fresh, stale = stale, nil
+	} else if fresh != nil && served != nil {
+		served.foundFresh(key, fresh)
+	}
+	switch {
+	case promoted:
+		span.SetAttributes(attrStatus.String("stale-while-revalidate"))
+	case fresh != nil:
+		span.SetAttributes(attrStatus.String("fresh"))
+	case stale != nil:
+		span.SetAttributes(attrStatus.String("stale"))
+	default:
+		span.SetAttributes(attrStatus.String("miss"))
+	}
+	if state != nil {
+		state.lookedUp(fresh != nil || stale != nil)
+	}
+
+	return fresh, stale
+}
+
+// SetMultiLevel observes and traces the write.
+func (i *instrumentedStorer) SetMultiLevel(baseKey, variedKey string, value []byte, variedHeaders http.Header, etag string, duration time.Duration, realKey string) error {
+	defer i.observe(nil, "set", time.Now())
+
+	store := &pendingStore{ctx: context.Background()}
+	if i.pending != nil {
+		if p, ok := i.pending.Load(baseKey); ok {
+			store = p.(*pendingStore)
+		}
+	}
+	_, span := startSpan(store.ctx, spanStore, attrStorer.String(i.Name()), keyHash(store.key))
+
+	err := i.Storer.SetMultiLevel(baseKey, variedKey, value, variedHeaders, etag, duration, realKey)
+	if err == nil {
+		span.SetAttributes(attrStatus.String("stored"))
+		cacheStats.addEntry(i.Name(), realKey, store.host, store.route)
+		if store.state != nil {
+			store.state.addStored(i.Name(), storedBodySize(value))
+		}
+	} else {
+		span.SetAttributes(attrStatus.String("error"))
+	}
+	endSpan(span, err)
+
+	return err
+}
+
+// storedBodySize returns the size of the body of the response dumped in the
+// stored value, the complete size of a response stored as chunks.
+func storedBodySize(value []byte) int64 {
+	end := bytes.Index(value, []byte("\r\n\r\n"))
+	if end < 0 {
+		return 0
+	}
+	if bytes.Contains(value[:end], []byte(chunksHeader)) {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(value[:end+4])), nil)
+		if err == nil && res.Header.Get(chunksHeader) == chunksStored {
+			return res.ContentLength
+		}
+	}
+
+	return int64(len(value) - end - 4)
+}
+
+// Delete counts the purged key and forgets its owner.
+func (i *instrumentedStorer) Delete(key string) {
+	if i.kept != nil && i.kept.kept(key) {
+		return
+	}
+	cacheStats.removeEntry(i.Name(), key)
+	defer i.observe(nil, "delete", time.Now())
+	if cacheMetrics.purges != nil {
+		cacheMetrics.purges.WithLabelValues(i.server(nil), i.handler, i.Name()).Inc()
+	}
+
+	i.Storer.Delete(key)
+}
+
+// DeleteMany counts the purge by pattern.
+func (i *instrumentedStorer) DeleteMany(key string) {
+	defer i.observe(nil, "delete", time.Now())
+	if cacheMetrics.purges != nil {
+		cacheMetrics.purges.WithLabelValues(i.server(nil), i.handler, i.Name()).Inc()
+	}
+
+	i.Storer.DeleteMany(key)
+}
+
+var _ types.Storer = (*instrumentedStorer)(nil)
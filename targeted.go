@@ -0,0 +1,89 @@
+package httpcache
+
+import (
+	"net/http"
+
+	"github.com/darkweak/souin/pkg/rfc"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	cdnCacheControl = "CDN-Cache-Control"
+
+	// The targeted field used by the cache is kept in the stored response
+	// with the original values of the fields it replaced.
+	targetedFieldHeader  = "Cache-Handler-Targeted-Field"
+	targetedOriginPrefix = "Cache-Handler-Original-"
+)
+
+// targetedFields returns the targeted cache control fields by precedence.
+func (s *SouinCaddyMiddleware) targetedFields() []string {
+	if cfg := s.Configuration.DefaultCache.TargetedCacheControl; cfg != nil {
+		return append(append([]string{}, cfg.Fields...), cdnCacheControl)
+	}
+
+	return []string{cdnCacheControl}
+}
+
+// applyTargetedCacheControl replaces the Cache-Control header of the upstream
+// response by the first valid targeted field as defined in RFC 9213, so the
+// Souin base handler uses it for every cache decision.
+func (s *SouinCaddyMiddleware) applyTargetedCacheControl(header http.Header) {
+	fields := s.targetedFields()
+	field, value := "", ""
+	for _, name := range fields {
+		v := rfc.HeaderAllCommaSepValuesString(header, name)
+		if v == "" {
+			continue
+		}
+		if _, err := cacheobject.ParseResponseCacheControl(v); err == nil {
+			field, value = name, v
+			break
+		}
+	}
+	if field == "" {
+		return
+	}
+
+	s.overrideCacheControl(header, field, value)
+}
+
+// overrideCacheControl replaces the Cache-Control header the Souin base
+// handler uses, the original cache control fields are kept to be restored
+// before the response is sent.
+func (s *SouinCaddyMiddleware) overrideCacheControl(header http.Header, field, value string) {
+	if header.Get(targetedFieldHeader) == "" {
+		for _, name := range append(s.targetedFields(), "Cache-Control") {
+			if values := header.Values(name); len(values) > 0 {
+				header[http.CanonicalHeaderKey(targetedOriginPrefix+name)] = values
+				header.Del(name)
+			}
+		}
+	}
+	header.Set("Cache-Control", value)
+	header.Set(targetedFieldHeader, field)
+}
+
+// restoreTargetedCacheControl restores the original cache control fields of
+// the response sent to the client, the targeted ones are removed when
+// configured.
+func (s *SouinCaddyMiddleware) restoreTargetedCacheControl(header http.Header) {
+	fields := s.targetedFields()
+	if header.Get(targetedFieldHeader) != "" {
+		header.Del("Cache-Control")
+		header.Del(targetedFieldHeader)
+		for _, name := range append(fields, "Cache-Control") {
+			origin := http.CanonicalHeaderKey(targetedOriginPrefix + name)
+			if values := header.Values(origin); len(values) > 0 {
+				header[http.CanonicalHeaderKey(name)] = values
+				header.Del(origin)
+			}
+		}
+	}
+
+	if cfg := s.Configuration.DefaultCache.TargetedCacheControl; cfg != nil && cfg.Strip {
+		for _, name := range fields {
+			header.Del(name)
+		}
+	}
+}
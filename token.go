@@ -0,0 +1,154 @@
+package httpcache
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	detailBypassToken  = "BYPASS-TOKEN"
+	detailRefreshToken = "REFRESH-TOKEN"
+
+	refreshCtxKey ctxKey = "cache_handler.REFRESH"
+
+	// defaultCacheName is the name the Souin base handler reports in the
+	// Cache-Status header when cache_name is not set.
+	defaultCacheName = "Souin"
+)
+
+// matches returns whether one of the token triggers carries the secret.
+func (t *CacheToken) matches(r *http.Request) bool {
+	if t == nil {
+		return false
+	}
+	values := make([]string, 0, 3)
+	if t.Header != "" {
+		values = append(values, r.Header.Get(t.Header))
+	}
+	if t.Cookie != "" {
+		if c, err := r.Cookie(t.Cookie); err == nil {
+			values = append(values, c.Value)
+		}
+	}
+	if t.Query != "" {
+		values = append(values, r.URL.Query().Get(t.Query))
+	}
+	for _, value := range values {
+		if value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(t.Secret)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// strip removes the token triggers from the request, the secret is neither
+// part of the key nor forwarded to the upstream.
+func (t *CacheToken) strip(r *http.Request) {
+	if t == nil {
+		return
+	}
+	if t.Header != "" {
+		r.Header.Del(t.Header)
+	}
+	if t.Cookie != "" && r.Header.Get("Cookie") != "" {
+		kept := make([]string, 0)
+		for _, c := range r.Cookies() {
+			if c.Name != t.Cookie {
+				kept = append(kept, c.Name+"="+c.Value)
+			}
+		}
+		r.Header.Del("Cookie")
+		if len(kept) > 0 {
+			r.Header.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+	if t.Query != "" && r.URL.RawQuery != "" {
+		kept := make([]string, 0)
+		for _, param := range strings.Split(r.URL.RawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if name != t.Query {
+				kept = append(kept, param)
+			}
+		}
+		u := *r.URL
+		u.RawQuery = strings.Join(kept, "&")
+		r.URL = &u
+		r.RequestURI = u.RequestURI()
+	}
+}
+
+// withTokens strips the bypass and refresh triggers from the request and
+// returns the detail of the token carrying the secret.
+func (s *SouinCaddyMiddleware) withTokens(r *http.Request) (*http.Request, string) {
+	dc := s.Configuration.DefaultCache
+	if (dc.BypassToken == nil && dc.RefreshToken == nil) || !s.isCachedMethod(r.Method) {
+		return r, ""
+	}
+
+	detail := ""
+	switch {
+	case dc.BypassToken.matches(r):
+		detail = detailBypassToken
+	case dc.RefreshToken.matches(r):
+		detail = detailRefreshToken
+	}
+	r = r.Clone(r.Context())
+	dc.BypassToken.strip(r)
+	dc.RefreshToken.strip(r)
+	if detail == detailRefreshToken {
+		r = r.WithContext(context.WithValue(r.Context(), refreshCtxKey, true))
+	}
+
+	return r, detail
+}
+
+// isRefresh returns whether the request carries the refresh token, the
+// storers are not looked up and the response is stored.
+func isRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(refreshCtxKey).(bool)
+
+	return refresh
+}
+
+// markRefresh reports the refresh in the Cache-Status header, the request
+// has been forwarded because of the token.
+func markRefresh(header http.Header) {
+	status := header.Get("Cache-Status")
+	if status == "" {
+		return
+	}
+	header.Set("Cache-Status", strings.Replace(status, "; fwd=uri-miss", "; fwd=request", 1)+"; detail="+detailRefreshToken)
+}
+
+// serveBypass forwards the request carrying the bypass token to the next
+// handler, the response is not stored.
+func (s *SouinCaddyMiddleware) serveBypass(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	crw := newCacheResponseWriter(rw)
+	r, state := withRequestState(r)
+	name := s.Configuration.DefaultCache.CacheName
+	if name == "" {
+		name = defaultCacheName
+	}
+	crw.Header().Set("Cache-Status", fmt.Sprintf("%s; fwd=bypass; detail=%s", name, detailBypassToken))
+
+	done := state.trackUpstream()
+	err := next.ServeHTTP(crw, s.forwardedRequest(r))
+	done()
+
+	result := parseCacheStatus(crw.Header().Get("Cache-Status"))
+	s.logCacheFields(r, result, state)
+	s.observeMetrics(r, result, state)
+	s.recordStats(r, result, crw, state)
+
+	return err
+}
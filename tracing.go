@@ -0,0 +1,82 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	xxhash "github.com/cespare/xxhash/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/caddyserver/cache-handler"
+
+const (
+	spanKey        = "cache.key"
+	spanLookup     = "cache.lookup"
+	spanUpstream   = "cache.upstream"
+	spanRevalidate = "cache.revalidate"
+	spanCoalescing = "cache.coalescing"
+	spanStore      = "cache.store"
+
+	attrKeyHash    = attribute.Key("cache.key_hash")
+	attrStatus     = attribute.Key("cache.status")
+	attrStorer     = attribute.Key("cache.storer")
+	attrStatusCode = attribute.Key("http.response.status_code")
+)
+
+// startSpan starts a child span of the span carried by the context. The
+// tracer provider is the one of the parent span, when the tracing handler
+// is not enabled the span is a no-op.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).
+		TracerProvider().
+		Tracer(tracerName).
+		Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startSpanAt starts a child span that began at the given time.
+func startSpanAt(ctx context.Context, name string, start time.Time, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).
+		TracerProvider().
+		Tracer(tracerName).
+		Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+}
+
+func isTracing(ctx context.Context) bool {
+	return trace.SpanFromContext(ctx).IsRecording()
+}
+
+// keyHash identifies the cache key without exposing it in the traces.
+func keyHash(key string) attribute.KeyValue {
+	return attrKeyHash.String(strconv.FormatUint(xxhash.Sum64String(key), 16))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceCoalescing adds the span of the time spent waiting for the response
+// of a concurrent request to the same key.
+func (s *SouinCaddyMiddleware) traceCoalescing(r *http.Request, key string, result cacheResult, state *requestState) {
+	if s.Configuration.DefaultCache.DisableCoalescing || result.Outcome != outcomeMiss {
+		return
+	}
+	if _, called := state.upstream(); called {
+		return
+	}
+	_, lookupEnd := state.lookup()
+	if lookupEnd.IsZero() {
+		return
+	}
+
+	_, span := startSpanAt(r.Context(), spanCoalescing, lookupEnd, keyHash(key))
+	span.End()
+}
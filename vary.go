@@ -0,0 +1,170 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+	deviceDesktop = "desktop"
+)
+
+// defaultVaryEncodings are the content codings by server preference used
+// when accept_encoding has no argument.
+var defaultVaryEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+// qualityValue is an element of a header list with its weight, e.g. gzip;q=0.8.
+type qualityValue struct {
+	value string
+	q     float64
+}
+
+// parseQualityValues parses a weighted list header value as defined in
+// RFC 9110 section 12.4.2.
+func parseQualityValues(header string) []qualityValue {
+	values := make([]qualityValue, 0)
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, weight, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(weight, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		values = append(values, qualityValue{value: value, q: q})
+	}
+
+	return values
+}
+
+// normalizeAcceptEncoding returns the accepted coding with the highest weight,
+// the server preference breaks the ties. It returns identity when none of the
+// codings is accepted.
+func normalizeAcceptEncoding(header string, codings []string) string {
+	accepted := parseQualityValues(header)
+	best, bestQ := "identity", 0.0
+	for _, coding := range codings {
+		q, wildcard := -1.0, -1.0
+		for _, a := range accepted {
+			switch a.value {
+			case coding:
+				q = a.q
+			case "*":
+				wildcard = a.q
+			}
+		}
+		if q < 0 {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// languageMatches returns whether the language range matches the language,
+// directly or by truncation of one of them.
+func languageMatches(languageRange, language string) bool {
+	languageRange, language = strings.ToLower(languageRange), strings.ToLower(language)
+
+	return languageRange == "*" || languageRange == language ||
+		strings.HasPrefix(language, languageRange+"-") || strings.HasPrefix(languageRange, language+"-")
+}
+
+// normalizeAcceptLanguage returns the configured language matching the
+// language range with the highest weight, the first configured language is
+// the default one.
+func normalizeAcceptLanguage(header string, languages []string) string {
+	best, bestQ := languages[0], 0.0
+	for _, r := range parseQualityValues(header) {
+		if r.q <= bestQ {
+			continue
+		}
+		for _, language := range languages {
+			if languageMatches(r.value, language) {
+				best, bestQ = language, r.q
+				break
+			}
+		}
+	}
+
+	return best
+}
+
+// deviceClass returns the device class of the User-Agent.
+func deviceClass(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "Tablet"),
+		strings.Contains(userAgent, "Android") && !strings.Contains(userAgent, "Mobile"):
+		return deviceTablet
+	case strings.Contains(userAgent, "Mobi"), strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "Android"):
+		return deviceMobile
+	}
+
+	return deviceDesktop
+}
+
+// normalizedVaryHeaders returns the canonical values of the request headers
+// the responses vary on. The upstream receives them as well, except the
+// User-Agent that is only normalized in the cache.
+func (s *SouinCaddyMiddleware) normalizedVaryHeaders(r *http.Request, upstream bool) map[string]string {
+	n := s.Configuration.DefaultCache.VaryNormalize
+	if n == nil && s.transcoder == nil {
+		return nil
+	}
+	if n == nil {
+		n = &VaryNormalize{}
+	}
+
+	headers := make(map[string]string)
+	switch {
+	case s.transcoder != nil:
+		// The stored response is encoded for each client.
+		headers["Accept-Encoding"] = "identity"
+	case len(n.AcceptEncoding) > 0:
+		headers["Accept-Encoding"] = normalizeAcceptEncoding(r.Header.Get("Accept-Encoding"), n.AcceptEncoding)
+	}
+	if len(n.AcceptLanguage) > 0 {
+		headers["Accept-Language"] = normalizeAcceptLanguage(r.Header.Get("Accept-Language"), n.AcceptLanguage)
+	}
+	if n.DeviceClass && !upstream {
+		headers["User-Agent"] = deviceClass(r.Header.Get("User-Agent"))
+	}
+
+	return headers
+}
+
+// withHeaders returns the request with the header values, the headers are
+// cloned when at least one of them changes.
+func withHeaders(r *http.Request, headers map[string]string) *http.Request {
+	changed := false
+	for name, value := range headers {
+		if values := r.Header.Values(name); len(values) != 1 || values[0] != value {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return r
+	}
+
+	rq := r.WithContext(r.Context())
+	rq.Header = r.Header.Clone()
+	for name, value := range headers {
+		rq.Header.Set(name, value)
+	}
+
+	return rq
+}
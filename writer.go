@@ -0,0 +1,92 @@
+package httpcache
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// cacheResponseWriter wraps the client response writer to keep
+// track of what the cache handler really sent to the client.
+type cacheResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	status int
+	size   int64
+	// Called with the response headers before they are sent.
+	beforeWriteHeader func(http.Header)
+}
+
+func newCacheResponseWriter(rw http.ResponseWriter) *cacheResponseWriter {
+	return &cacheResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rw},
+	}
+}
+
+// WriteHeader records the status code sent to the client.
+func (w *cacheResponseWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+		if w.beforeWriteHeader != nil {
+			w.beforeWriteHeader(w.Header())
+		}
+	}
+	w.ResponseWriterWrapper.WriteHeader(code)
+}
+
+// Write records the amount of bytes sent to the client.
+func (w *cacheResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriterWrapper.Write(b)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// ReadFrom records the amount of bytes sent to the client.
+func (w *cacheResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriterWrapper.ReadFrom(r)
+	w.size += n
+
+	return n, err
+}
+
+// Status returns the status code sent to the client.
+func (w *cacheResponseWriter) Status() int {
+	return w.status
+}
+
+// Size returns the amount of bytes sent to the client.
+func (w *cacheResponseWriter) Size() int64 {
+	return w.size
+}
+
+// discardResponseWriter is the response writer of the requests made by the
+// cache itself, e.g. the background revalidations.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: http.Header{}}
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (*discardResponseWriter) WriteHeader(int) {}
+
+var (
+	_ http.ResponseWriter = (*cacheResponseWriter)(nil)
+	_ http.ResponseWriter = (*discardResponseWriter)(nil)
+)